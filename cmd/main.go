@@ -10,7 +10,10 @@ import (
 	httpapi "github.com/ostafen/hermes/internal/api/http"
 	"github.com/ostafen/hermes/internal/config"
 	"github.com/ostafen/hermes/internal/processor"
+	"github.com/ostafen/hermes/internal/projections"
+	"github.com/ostafen/hermes/internal/registry"
 	"github.com/ostafen/hermes/internal/service"
+	"github.com/ostafen/hermes/internal/store"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -53,7 +56,22 @@ func main() {
 
 	setupLogging(cfg.Logging)
 
-	svc := service.NewProjectionService(makeProcessorConfig(cfg))
+	procCfg := makeProcessorConfig(cfg)
+	procCfg.InternalStreams = []string{projectionsTopic(cfg)}
+
+	if err := processor.CheckStorage(procCfg); err != nil {
+		log.Fatal(err)
+	}
+
+	st, err := store.NewKafkaStore(cfg.Kafka.Brokers, projectionsTopic(cfg), procCfg.Replication)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	svc, err := service.NewProjectionService(procCfg, st)
+	if err != nil {
+		log.Fatal(err)
+	}
 	defer svc.Shutdown()
 
 	setupRouter(svc)
@@ -80,9 +98,44 @@ func makeProcessorConfig(cfg *config.Config) processor.Config {
 		procCfg.StoragePath = cfg.Processor.StoragePath
 	}
 
+	if cfg.Processor.DiscoveryInterval > 0 {
+		procCfg.DiscoveryInterval = cfg.Processor.DiscoveryInterval
+	}
+
+	if cfg.Processor.MinFreeSpaceMB > 0 {
+		procCfg.MinFreeSpace = uint64(cfg.Processor.MinFreeSpaceMB) << 20
+	}
+
+	if cfg.Kafka.SchemaRegistry != "" {
+		procCfg.SchemaRegistry = registry.NewClient(cfg.Kafka.SchemaRegistry, nil)
+	}
+
+	procCfg.ExactlyOnce = cfg.Processor.ExactlyOnce
+	if cfg.Processor.CommitInterval > 0 {
+		procCfg.CommitInterval = cfg.Processor.CommitInterval
+	}
+
+	if cfg.Processor.InstanceID != "" {
+		procCfg.InstanceID = cfg.Processor.InstanceID
+	}
+
+	if len(cfg.Processor.Inputs) > 0 {
+		procCfg.Inputs = make(map[string]projections.InputMapping, len(cfg.Processor.Inputs))
+		for stream, in := range cfg.Processor.Inputs {
+			procCfg.Inputs[stream] = projections.InputMapping(in)
+		}
+	}
+
 	return procCfg
 }
 
+func projectionsTopic(cfg *config.Config) string {
+	if cfg.Kafka.ProjectionsTopic != "" {
+		return cfg.Kafka.ProjectionsTopic
+	}
+	return store.DefaultTopic
+}
+
 func setupLogging(config config.Log) {
 	log.SetReportCaller(true)
 	log.SetLevel(getLogLevel(config.Level))
@@ -120,8 +173,15 @@ func setupRouter(svc service.ProjectionService) {
 
 	controller := httpapi.NewProjectionsController(svc)
 
+	r.HandleFunc("/projections", controller.List).Methods("GET")
+	r.HandleFunc("/projections/{name}", controller.Get).Methods("GET")
+	r.HandleFunc("/projections/{name}/state", controller.GetState).Methods("GET")
 	r.HandleFunc("/projections/{name}", controller.Create).Methods("POST")
-	r.HandleFunc("/projections/{id}", controller.Delete).Methods("DELETE")
+	r.HandleFunc("/projections/{name}", controller.Delete).Methods("DELETE")
+	r.HandleFunc("/projections/{name}/query", controller.UpdateQuery).Methods("PUT")
+	r.HandleFunc("/projections/{name}/reset", controller.Reset).Methods("POST")
+	r.HandleFunc("/projections/{name}/enable", controller.Enable).Methods("POST")
+	r.HandleFunc("/projections/{name}/disable", controller.Disable).Methods("POST")
 
 	http.Handle("/", r)
 }
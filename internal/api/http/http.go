@@ -1,10 +1,15 @@
 package http
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
+	"github.com/ostafen/hermes/internal/processor"
 	"github.com/ostafen/hermes/internal/service"
 )
 
@@ -38,7 +43,7 @@ func (c *ProjectionsController) Create(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if err != nil {
-		writeError(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), errorStatus(err))
 		return
 	}
 }
@@ -46,15 +51,182 @@ func (c *ProjectionsController) Create(w http.ResponseWriter, r *http.Request) {
 func (c *ProjectionsController) Delete(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	err := c.svc.Delete(r.Context(), service.DeleteProjectionInput{
+	deleteState, err := boolParam(r, "deleteState")
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deleteEmittedStreams, err := boolParam(r, "deleteEmittedStreams")
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = c.svc.Delete(r.Context(), service.DeleteProjectionInput{
+		Name:                 vars["name"],
+		DeleteState:          deleteState,
+		DeleteEmittedStreams: deleteEmittedStreams,
+	})
+	if err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+}
+
+func (c *ProjectionsController) UpdateQuery(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	reset, err := boolParam(r, "reset")
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if len(query) == 0 {
+		writeError(w, "query must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	err = c.svc.UpdateQuery(r.Context(), service.UpdateQueryInput{
+		Name:  vars["name"],
+		Query: string(query),
+		Reset: reset,
+	})
+	if err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+}
+
+func (c *ProjectionsController) Reset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := c.svc.Reset(r.Context(), service.ResetProjectionInput{
+		Name: vars["name"],
+	})
+	if err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+}
+
+func (c *ProjectionsController) Enable(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := c.svc.Enable(r.Context(), service.EnableProjectionInput{
 		Name: vars["name"],
 	})
+	if err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+}
+
+func (c *ProjectionsController) Disable(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := c.svc.Disable(r.Context(), service.DisableProjectionInput{
+		Name: vars["name"],
+	})
+	if err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+}
+
+func (c *ProjectionsController) Get(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	info, err := c.svc.Get(r.Context(), service.GetProjectionInput{
+		Name: vars["name"],
+	})
+	if err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, info)
+}
+
+func (c *ProjectionsController) List(w http.ResponseWriter, r *http.Request) {
+	infos, err := c.svc.List(r.Context())
+	if err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, infos)
+}
+
+func (c *ProjectionsController) GetState(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	in := service.GetStateInput{
+		Name: vars["name"],
+	}
+
+	if query := r.URL.Query(); query.Has("partition") {
+		partition := query.Get("partition")
+		in.Partition = &partition
+	}
+
+	state, err := c.svc.GetState(r.Context(), in)
+	if err != nil {
+		writeError(w, err.Error(), errorStatus(err))
+		return
+	}
+	writeJSON(w, state)
+}
+
+func boolParam(r *http.Request, name string) (bool, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value for parameter %s: %s", name, value)
+	}
+	return b, nil
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrInvalidQuery),
+		errors.Is(err, service.ErrPartitionRequired),
+		errors.Is(err, service.ErrPartitionNotUsed):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrProjectionStopped):
+		return http.StatusConflict
+	case errors.Is(err, processor.ErrStateNotReady):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, service.ErrProjectionNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrProjectionExist),
+		errors.Is(err, service.ErrProjectionInvalid),
+		errors.Is(err, service.ErrProjectionBusy):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	data, err := json.Marshal(v)
 	if err != nil {
 		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
 }
 
 func writeError(w http.ResponseWriter, errMsg string, status int) {
-	http.Error(w, errMsg, http.StatusInternalServerError)
+	http.Error(w, errMsg, status)
 }
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/mitchellh/mapstructure"
@@ -10,13 +11,29 @@ import (
 )
 
 type Kafka struct {
-	Brokers []string `mapstructure:"brokers" validate:"required"`
+	Brokers          []string `mapstructure:"brokers" validate:"required"`
+	ProjectionsTopic string   `mapstructure:"projectionsTopic"`
+	SchemaRegistry   string   `mapstructure:"schemaRegistry"`
 }
 
 type Processor struct {
-	StoragePath string `mapstructure:"storagePath"`
-	Replication int    `mapstructure:"replication"`
-	Partitions  int    `mapstructure:"partitions"`
+	StoragePath       string           `mapstructure:"storagePath"`
+	MinFreeSpaceMB    int              `mapstructure:"minFreeSpaceMB"`
+	Replication       int              `mapstructure:"replication"`
+	Partitions        int              `mapstructure:"partitions"`
+	DiscoveryInterval time.Duration    `mapstructure:"discoveryInterval"`
+	ExactlyOnce       bool             `mapstructure:"exactlyOnce"`
+	CommitInterval    time.Duration    `mapstructure:"commitInterval"`
+	InstanceID        string           `mapstructure:"instanceId"`
+	Inputs            map[string]Input `mapstructure:"inputs"`
+}
+
+// Input is the mapping of the records of a stream which don't hold the envelope of an event.
+type Input struct {
+	Type        string            `mapstructure:"type"`
+	EventId     string            `mapstructure:"eventId"`
+	ContentType string            `mapstructure:"contentType"`
+	Metadata    map[string]string `mapstructure:"metadata"`
 }
 
 type Log struct {
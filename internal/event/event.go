@@ -1,5 +1,11 @@
 package event
 
+import (
+	"encoding/json"
+	"mime"
+	"strings"
+)
+
 type Metadata map[string]string
 
 const (
@@ -16,13 +22,49 @@ const (
 	ContentTypeJson ContentType = "application/json"
 )
 
+// EventData is the envelope of the events read and written by projections.
+//
+// The payload of JSON events is carried as is in Data. Other payloads are carried as a string:
+// text as it is, binary data base64 encoded, as encoding/json does with byte slices.
 type EventData struct {
-	EventID     string `json:"eventId"`
-	ContentType ContentType
-	Metadata    Metadata `json:"metadata"`
-	Data        any      `json:"data"`
+	EventID     string      `json:"eventId"`
+	ContentType ContentType `json:"contentType"`
+	Metadata    Metadata    `json:"metadata"`
+	Data        any         `json:"data"`
+
+	// RawData is the payload, as read from the envelope.
+	RawData json.RawMessage `json:"-"`
 }
 
+// IsJson reports whether the payload is JSON. Events without a content type are assumed to be JSON.
 func (data *EventData) IsJson() bool {
-	return data.ContentType == ContentTypeJson
+	if data.ContentType == "" {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(string(data.ContentType))
+	if err != nil {
+		return false
+	}
+	return mediaType == string(ContentTypeJson) || strings.HasSuffix(mediaType, "+json")
+}
+
+func (data *EventData) UnmarshalJSON(b []byte) error {
+	type envelope EventData
+
+	var in struct {
+		*envelope
+		Data json.RawMessage `json:"data"`
+	}
+	in.envelope = (*envelope)(data)
+
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	data.RawData = in.Data
+	if len(in.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(in.Data, &data.Data)
 }
@@ -0,0 +1,48 @@
+package event_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ostafen/hermes/internal/event"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsJson(t *testing.T) {
+	for contentType, isJson := range map[event.ContentType]bool{
+		"":                                true,
+		"application/json":                true,
+		"application/json; charset=utf-8": true,
+		"application/cloudevents+json":    true,
+		"text/plain":                      false,
+		"application/octet-stream":        false,
+		"not a media type;;":              false,
+	} {
+		data := event.EventData{ContentType: contentType}
+		require.Equal(t, isJson, data.IsJson(), contentType)
+	}
+}
+
+func TestUnmarshalPayload(t *testing.T) {
+	var data event.EventData
+	require.NoError(t, json.Unmarshal([]byte(`{"eventId":"1","data":{"amount": 10}}`), &data))
+	require.Equal(t, map[string]any{"amount": float64(10)}, data.Data)
+	require.JSONEq(t, `{"amount": 10}`, string(data.RawData))
+
+	binary, err := json.Marshal(event.EventData{
+		ContentType: "application/octet-stream",
+		Data:        []byte{0xde, 0xad, 0xbe, 0xef},
+	})
+	require.NoError(t, err)
+
+	data = event.EventData{}
+	require.NoError(t, json.Unmarshal(binary, &data))
+	require.False(t, data.IsJson())
+	require.Equal(t, "3q2+7w==", data.Data)
+
+	// payloads are decoded into the value held by Data, if any
+	payload := &struct{ Amount int }{}
+	data = event.EventData{Data: payload}
+	require.NoError(t, json.Unmarshal([]byte(`{"data":{"amount": 10}}`), &data))
+	require.Equal(t, 10, payload.Amount)
+}
@@ -0,0 +1,381 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Shopify/sarama"
+	"github.com/lovoo/goka"
+	"github.com/ostafen/hermes/internal/projections"
+)
+
+// Reset deletes the state of a projection and rewinds its consumer groups to the earliest offset,
+// so that the next processor built for it reprocesses its input streams from the beginning.
+// The processor of the projection must not be running.
+func Reset(p *projections.Projection, cfg Config) error {
+	r, err := newClusterAdmin(cfg)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// the group table is compacted, which does not allow records to be deleted, so its keys are deleted instead
+	if err := r.clearTable(tableTopic(p.Name)); err != nil {
+		return err
+	}
+
+	for _, topic := range []string{loopTopic(p.Name), partitionByTopic(p.Name)} {
+		if err := r.truncate(topic); err != nil {
+			return err
+		}
+	}
+
+	stages, err := resolveStages(r.client, cfg, p)
+	if err != nil {
+		return err
+	}
+
+	for group, streams := range stages {
+		if err := commitEarliestOffsets(r.client, group, streams...); err != nil {
+			return err
+		}
+	}
+
+	if err := commitEarliestOffsets(r.client, groupName(p.Name), partitionByTopic(p.Name)); err != nil {
+		return err
+	}
+	return removeLocalStorage(p.Name, cfg)
+}
+
+func removeLocalStorage(name string, cfg Config) error {
+	if cfg.StoragePath == InMemoryStorage {
+		return nil
+	}
+
+	for _, group := range []string{groupName(name), groupName(name) + "-view"} {
+		if err := os.RemoveAll(storageDir(cfg, group)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type DeleteOptions struct {
+	// State deletes the internal topics, the consumer groups and the local storage of the projection.
+	State bool
+	// EmittedStreams deletes the streams the projection writes to, including the ones written by emit() and linkTo().
+	EmittedStreams bool
+}
+
+// Delete removes the artifacts of a projection selected by opts.
+// The processor of the projection must not be running.
+func Delete(p *projections.Projection, cfg Config, opts DeleteOptions) error {
+	if !opts.State && !opts.EmittedStreams {
+		return nil
+	}
+
+	r, err := newClusterAdmin(cfg)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	topics := make([]string, 0)
+	if opts.State {
+		topics = append(topics, tableTopic(p.Name), loopTopic(p.Name), partitionByTopic(p.Name))
+	}
+
+	if opts.EmittedStreams {
+		topics = append(topics, p.ResultStream())
+
+		if p.OutputsState() {
+			topics = append(topics, p.StateStream())
+		}
+
+		if p.ErrorPolicy() == projections.ErrorPolicyDeadLetter {
+			topics = append(topics, p.DeadLetterStream())
+		}
+
+		emitted, err := r.liveTopicKeys(emittedStreamsTopic(p.Name))
+		if err != nil {
+			return err
+		}
+		topics = append(topics, emitted...)
+	}
+
+	// the emitted streams are recorded until they are deleted, or until the state of the projection is
+	topics = append(topics, emittedStreamsTopic(p.Name))
+
+	for _, topic := range topics {
+		if err := r.deleteTopic(topic); err != nil {
+			return err
+		}
+	}
+
+	if !opts.State {
+		return nil
+	}
+
+	groups, err := r.admin.ListConsumerGroups()
+	if err != nil {
+		return err
+	}
+
+	for group := range groups {
+		if !isGroupOf(p.Name, group) {
+			continue
+		}
+
+		if err := r.deleteGroup(group); err != nil {
+			return err
+		}
+	}
+	return removeLocalStorage(p.Name, cfg)
+}
+
+// isGroupOf reports whether group is a consumer group of the projection with the given name: its main group,
+// or the group of one of its partition stages, whose name is suffixed by the number of partitions of its streams
+// for projections using dynamic selectors.
+func isGroupOf(name, group string) bool {
+	if group == groupName(name) || group == partitionByGroupName(name) {
+		return true
+	}
+
+	partitions := strings.TrimPrefix(group, partitionByGroupName(name)+"-")
+	if partitions == group {
+		return false
+	}
+
+	n, err := strconv.Atoi(partitions)
+	return err == nil && n > 0 && strconv.Itoa(n) == partitions
+}
+
+func tableTopic(name string) string {
+	return string(goka.GroupTable(goka.Group(groupName(name))))
+}
+
+// loopTopic returns the loop topic of the main group of a projection, as named by goka.
+func loopTopic(name string) string {
+	return groupName(name) + "-loop"
+}
+
+type clusterAdmin struct {
+	brokers []string
+	client  sarama.Client
+	admin   sarama.ClusterAdmin
+}
+
+func newClusterAdmin(cfg Config) (*clusterAdmin, error) {
+	client, err := sarama.NewClient(cfg.Brokers, kafkaCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &clusterAdmin{brokers: cfg.Brokers, client: client, admin: admin}, nil
+}
+
+// Close closes the admin, together with the underlying client.
+func (r *clusterAdmin) Close() error {
+	return r.admin.Close()
+}
+
+func (r *clusterAdmin) deleteTopic(topic string) error {
+	err := r.admin.DeleteTopic(topic)
+	if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return nil
+	}
+	return err
+}
+
+func (r *clusterAdmin) deleteGroup(group string) error {
+	err := r.admin.DeleteConsumerGroup(group)
+	if errors.Is(err, sarama.ErrGroupIDNotFound) {
+		return nil
+	}
+	return err
+}
+
+// truncate deletes all the records of a topic, if it exists. Compacted topics cannot be truncated.
+func (r *clusterAdmin) truncate(topic string) error {
+	partitions, err := r.client.Partitions(topic)
+	if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	offsets := make(map[int32]int64, len(partitions))
+	for _, partition := range partitions {
+		offset, err := r.client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+		offsets[partition] = offset
+	}
+	return r.admin.DeleteRecords(topic, offsets)
+}
+
+// clearTable deletes every key of a compacted topic, if it exists, by writing a tombstone for each key with a value.
+func (r *clusterAdmin) clearTable(topic string) error {
+	partitions, err := r.client.Partitions(topic)
+	if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	tombstones := make([]*sarama.ProducerMessage, 0)
+	for _, partition := range partitions {
+		keys, err := r.liveKeys(topic, partition)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			tombstones = append(tombstones, &sarama.ProducerMessage{
+				Topic:     topic,
+				Partition: partition,
+				Key:       sarama.StringEncoder(key),
+			})
+		}
+	}
+
+	if len(tombstones) == 0 {
+		return nil
+	}
+
+	conf := *kafkaCfg
+	conf.Producer.Partitioner = sarama.NewManualPartitioner
+	conf.Producer.Return.Successes = true
+
+	producer, err := sarama.NewSyncProducer(r.brokers, &conf)
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	return producer.SendMessages(tombstones)
+}
+
+// liveTopicKeys returns the keys of a compacted topic whose last record is not a tombstone, if the topic exists.
+func (r *clusterAdmin) liveTopicKeys(topic string) ([]string, error) {
+	partitions, err := r.client.Partitions(topic)
+	if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, partition := range partitions {
+		partitionKeys, err := r.liveKeys(topic, partition)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, partitionKeys...)
+	}
+	return keys, nil
+}
+
+// liveKeys returns the keys of a partition of a compacted topic whose last record is not a tombstone.
+// Records of aborted transactions are read too, which at worst deletes keys which are already absent.
+func (r *clusterAdmin) liveKeys(topic string, partition int32) ([]string, error) {
+	offset, err := r.client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := r.client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return nil, err
+	}
+
+	live := make(map[string]bool)
+	for offset < end {
+		res, err := fetchRecords(r.client, topic, partition, offset, sarama.ReadUncommitted)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, msg := range res.records {
+			live[string(msg.Key)] = msg.Value != nil
+		}
+
+		if res.next <= offset {
+			return nil, fmt.Errorf("unable to read %s/%d at offset %d", topic, partition, offset)
+		}
+		offset = res.next
+	}
+
+	keys := make([]string, 0, len(live))
+	for key, isLive := range live {
+		if isLive {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// commitEarliestOffsets commits the earliest available offset of every partition of the given topics for a consumer group.
+func commitEarliestOffsets(client sarama.Client, group string, topics ...string) error {
+	req := &sarama.OffsetCommitRequest{
+		Version:                 2,
+		ConsumerGroup:           group,
+		ConsumerGroupGeneration: sarama.GroupGenerationUndefined,
+		RetentionTime:           -1,
+	}
+
+	var blocks int
+	for _, topic := range topics {
+		partitions, err := client.Partitions(topic)
+		if errors.Is(err, sarama.ErrUnknownTopicOrPartition) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, partition := range partitions {
+			offset, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+			if err != nil {
+				return err
+			}
+			req.AddBlock(topic, partition, offset, 0, sarama.ReceiveTime, "")
+			blocks++
+		}
+	}
+
+	if blocks == 0 {
+		return nil
+	}
+
+	coordinator, err := client.Coordinator(group)
+	if err != nil {
+		return err
+	}
+
+	resp, err := coordinator.CommitOffset(req)
+	if err != nil {
+		return err
+	}
+
+	for _, partitions := range resp.Errors {
+		for _, kerr := range partitions {
+			if kerr != sarama.ErrNoError {
+				return kerr
+			}
+		}
+	}
+	return nil
+}
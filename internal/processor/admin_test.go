@@ -0,0 +1,29 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsGroupOf(t *testing.T) {
+	tests := []struct {
+		group string
+		is    bool
+	}{
+		{group: "a-group", is: true},
+		{group: "a-partition-by-group", is: true},
+		{group: "a-partition-by-group-3", is: true},
+		{group: "a-b-group"},
+		{group: "a-b-partition-by-group"},
+		{group: "a-b-partition-by-group-3"},
+		{group: "a-partition-by-group-b"},
+		{group: "a-partition-by-group-03"},
+		{group: "a-partition-by-group-0"},
+		{group: "a-partition-by-group-"},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.is, isGroupOf("a", test.group), test.group)
+	}
+}
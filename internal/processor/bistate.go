@@ -0,0 +1,224 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+
+	"github.com/lovoo/goka"
+	"github.com/lovoo/goka/codec"
+	"github.com/ostafen/hermes/internal/projections"
+)
+
+// The shared state of a bi-state projection is stored under the projections.SharedStateKey of the group table.
+//
+// goka only allows a callback to update the value of the key being processed, and the partitions of a projection
+// are processed concurrently, possibly by different instances. So handlers read the shared state from the view
+// over the group table, and the changes they make to it are sent as a sharedUpdate through the loop topic of the group
+// to the shared key, where the changes of every partition are merged.
+// Handlers thus see the shared state without the changes which are not merged yet, including the ones of their own partition.
+
+// sharedUpdate is a change made to the shared state while processing an event.
+type sharedUpdate struct {
+	// Init is the initial shared state the change applies to, if the shared state was not set yet.
+	Init  any          `json:"init,omitempty"`
+	Delta *sharedDelta `json:"delta"`
+}
+
+// sharedDelta is a change to a value of the shared state. Numbers are changed by adding the difference between
+// the new and the old value, so that the changes of concurrent partitions to a count or a total add up,
+// objects are changed property by property, and other values are replaced.
+type sharedDelta struct {
+	Add     float64 `json:"add,omitempty"`
+	Replace bool    `json:"replace,omitempty"`
+	Value   any     `json:"value,omitempty"`
+	// Fields are the changes to the properties of an object, nil deleting the property.
+	Fields map[string]*sharedDelta `json:"fields,omitempty"`
+}
+
+// diffShared returns the change turning old into new, or nil if they are equal. Values must be decoded from JSON.
+func diffShared(old, new any) *sharedDelta {
+	switch n := new.(type) {
+	case float64:
+		if o, isNumber := old.(float64); isNumber {
+			if n == o {
+				return nil
+			}
+			return &sharedDelta{Add: n - o}
+		}
+	case map[string]any:
+		if o, isObject := old.(map[string]any); isObject {
+			fields := make(map[string]*sharedDelta)
+			for k, v := range n {
+				if ov, has := o[k]; !has {
+					fields[k] = &sharedDelta{Replace: true, Value: v}
+				} else if d := diffShared(ov, v); d != nil {
+					fields[k] = d
+				}
+			}
+
+			for k := range o {
+				if _, has := n[k]; !has {
+					fields[k] = nil
+				}
+			}
+
+			if len(fields) == 0 {
+				return nil
+			}
+			return &sharedDelta{Fields: fields}
+		}
+	}
+
+	if reflect.DeepEqual(old, new) {
+		return nil
+	}
+	return &sharedDelta{Replace: true, Value: new}
+}
+
+// apply returns value with the change applied. Values changed by another partition in the meantime are still updated:
+// numbers added to a value which is not a number anymore start from zero, and so do fields of values which are not objects.
+func (d *sharedDelta) apply(value any) any {
+	switch {
+	case d.Replace:
+		return d.Value
+	case d.Fields != nil:
+		obj, _ := value.(map[string]any)
+
+		res := make(map[string]any, len(obj)+len(d.Fields))
+		for k, v := range obj {
+			res[k] = v
+		}
+
+		for k, fd := range d.Fields {
+			if fd == nil {
+				delete(res, k)
+			} else {
+				res[k] = fd.apply(res[k])
+			}
+		}
+		return res
+	}
+
+	n, _ := value.(float64)
+	return n + d.Add
+}
+
+// sharedStateEdges returns the loop edge merging the changes to the shared state into the group table.
+func sharedStateEdges(p *projections.Projection, txn *txnProducer) []goka.Edge {
+	if !p.IsBiState() {
+		return nil
+	}
+
+	return []goka.Edge{
+		goka.Loop(&codec.Bytes{}, txn.wrap(mergeSharedState)),
+	}
+}
+
+func mergeSharedState(ctx goka.Context, msg any) {
+	data, _ := msg.([]byte)
+
+	var update sharedUpdate
+	if err := json.Unmarshal(data, &update); err != nil {
+		ctx.Fail(err)
+	}
+
+	state, err := getState(ctx)
+	if err != nil {
+		ctx.Fail(err)
+	}
+
+	if state == nil {
+		state = update.Init
+	}
+
+	if update.Delta != nil {
+		state = update.Delta.apply(state)
+	}
+
+	if err := setState(ctx, state); err != nil {
+		ctx.Fail(err)
+	}
+}
+
+// getSharedState returns the shared state as read from the view over the group table,
+// or the initial shared state of inst, reporting whether the shared state was not set yet.
+func (proc *Processor) getSharedState(inst *projections.Projection) (any, bool, error) {
+	proc.mtx.Lock()
+	view := proc.view
+	proc.mtx.Unlock()
+
+	val, err := view.Get(projections.SharedStateKey)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if data, _ := val.([]byte); data != nil {
+		state, err := decodeState(data)
+		return state, false, err
+	}
+
+	state, err := normalizeState(inst.InitSharedState())
+	return state, true, err
+}
+
+// setSharedState sends the changes made to the shared state, whose value was prev, to the shared key.
+func (proc *Processor) setSharedState(ctx goka.Context, prev any, initial bool, value any) error {
+	value, err := normalizeState(value)
+	if err != nil {
+		return err
+	}
+
+	update := sharedUpdate{Delta: diffShared(prev, value)}
+	if update.Delta == nil && !initial {
+		return nil
+	}
+
+	if initial {
+		update.Init = prev
+	}
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	ctx.Loopback(projections.SharedStateKey, data)
+	return nil
+}
+
+// normalizeState returns a state as decoded from the group table, where numbers are float64.
+func normalizeState(state any) (any, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(data)
+}
+
+// waitView waits until the view over the group table is recovered, which bi-state projections read the shared state from.
+func (p *Processor) waitView(ctx context.Context) error {
+	p.mtx.Lock()
+	view := p.view
+	p.mtx.Unlock()
+
+	select {
+	case <-view.WaitRunning():
+		return p.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runSharedStateView runs the view over the group table before the main processor of a bi-state projection,
+// whose handlers read the shared state from it.
+func (p *Processor) runSharedStateView(ctx context.Context) error {
+	if err := p.tpm.EnsureTableExists(string(goka.GroupTable(goka.Group(groupName(p.projection.Name)))), p.cfg.Partitions); err != nil {
+		return err
+	}
+
+	if err := p.runView(ctx); err != nil {
+		return err
+	}
+	return p.waitView(ctx)
+}
@@ -0,0 +1,73 @@
+package processor
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/lovoo/goka"
+	"github.com/ostafen/hermes/internal/projections"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedDelta(t *testing.T) {
+	old := map[string]any{"total": float64(10), "last": "a", "removed": true, "nested": map[string]any{"count": float64(1)}}
+
+	// two partitions change the same shared state concurrently
+	first := diffShared(old, map[string]any{"total": float64(15), "last": "b", "nested": map[string]any{"count": float64(2)}})
+	second := diffShared(old, map[string]any{"total": float64(13), "last": "c", "removed": true, "added": float64(1), "nested": map[string]any{"count": float64(1)}})
+
+	merged := second.apply(first.apply(old))
+	require.Equal(t, map[string]any{
+		"total":  float64(18),
+		"last":   "c",
+		"added":  float64(1),
+		"nested": map[string]any{"count": float64(2)},
+	}, merged)
+
+	// the merged value is not changed in place
+	require.Equal(t, float64(10), old["total"])
+
+	require.Nil(t, diffShared(old, map[string]any{"total": float64(10), "last": "a", "removed": true, "nested": map[string]any{"count": float64(1)}}))
+	require.Equal(t, []any{"x"}, diffShared(float64(1), []any{"x"}).apply(float64(1)))
+	// changes to a number deleted in the meantime start from zero
+	require.Equal(t, float64(2), diffShared(float64(1), float64(3)).apply(nil))
+}
+
+func TestSharedState(t *testing.T) {
+	proc, tt := newTestProcessor(t, `fromStream("orders").
+		partitionBy(e => e.body.customer).
+		when({
+			$init: () => ({ total: 0 }),
+			$initShared: () => ({ total: 0, orders: 0 }),
+			Added: (s, e) => {
+				s[0].total += e.body.amount
+				s[1].total += e.body.amount
+				s[1].orders += 1
+				s[1].last = e.body.customer
+			}
+		})`)
+
+	for i, customer := range []string{"c1", "c2", "c1"} {
+		tt.Consume("orders", "", eventRecord(t, "Added", map[string]any{"customer": customer, "amount": i + 1}))
+	}
+	require.NoError(t, proc.Err())
+
+	table := goka.GroupTable(goka.Group(groupName("test")))
+
+	shared, err := decodeState(tt.TableValue(table, projections.SharedStateKey))
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"total": float64(6), "orders": float64(3), "last": "c1"}, shared)
+
+	state, err := decodeState(tt.TableValue(table, "c1"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"total": float64(4)}, state)
+
+	// changes are merged into the shared state rather than replacing it
+	update, err := json.Marshal(sharedUpdate{Delta: &sharedDelta{Fields: map[string]*sharedDelta{"total": {Add: 10}}}})
+	require.NoError(t, err)
+	tt.Consume(loopTopic("test"), projections.SharedStateKey, update)
+
+	shared, err = decodeState(tt.TableValue(table, projections.SharedStateKey))
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"total": float64(16), "orders": float64(3), "last": "c1"}, shared)
+}
@@ -0,0 +1,101 @@
+package processor
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/lovoo/goka"
+	"github.com/ostafen/hermes/internal/projections"
+	"github.com/ostafen/hermes/internal/registry"
+	log "github.com/sirupsen/logrus"
+)
+
+// Stage identifies the processor where an event failed.
+type Stage string
+
+const (
+	StagePartition Stage = "partition"
+	StageProcess   Stage = "process"
+)
+
+const (
+	HeaderKeyError     = "hermes-error"
+	HeaderKeyStage     = "hermes-stage"
+	HeaderKeyTopic     = "hermes-topic"
+	HeaderKeyPartition = "hermes-partition"
+	HeaderKeyOffset    = "hermes-offset"
+)
+
+// handleFailure applies the error policy of the projection to an event which could not be handled.
+// Errors of the schema registry being unavailable always stop the processor.
+func (proc *Processor) handleFailure(ctx goka.Context, p *projections.Projection, stage Stage, rawMessage []byte, err error) {
+	src := sourceOf(ctx)
+
+	logger := log.WithFields(log.Fields{
+		"projection": p.Name,
+		"stage":      stage,
+		"topic":      src.topic,
+		"partition":  src.partition,
+		"offset":     src.offset,
+	})
+
+	// the event is not at fault when the schema registry is unavailable: the processor stops rather than skipping it,
+	// so that the event is processed again once restarted
+	if errors.Is(err, registry.ErrUnavailable) {
+		ctx.Fail(err)
+	}
+
+	switch p.ErrorPolicy() {
+	case projections.ErrorPolicyFail:
+		ctx.Fail(err)
+	case projections.ErrorPolicyDeadLetter:
+		logger.Warn(err)
+
+		rec := proc.sourceRecord(ctx, src, rawMessage)
+
+		headers := goka.Headers{
+			HeaderKeyError:     []byte(err.Error()),
+			HeaderKeyStage:     []byte(stage),
+			HeaderKeyTopic:     []byte(src.topic),
+			HeaderKeyPartition: []byte(strconv.FormatInt(int64(src.partition), 10)),
+			HeaderKeyOffset:    []byte(strconv.FormatInt(src.offset, 10)),
+		}
+		ctx.Emit(goka.Stream(p.DeadLetterStream()), rec.key, rec.value, goka.WithCtxEmitHeaders(rec.headers.Merged(headers)))
+	default:
+		logger.Error(err)
+	}
+}
+
+// sourceRecord returns the record an event was read from, whose raw message is given.
+// Events forwarded by the partition stages hold the envelope of the event and the partition key,
+// so their source record is read again, falling back to the forwarded record if it is not available anymore.
+func (proc *Processor) sourceRecord(ctx goka.Context, src eventSource, rawMessage []byte) inputRecord {
+	rec := inputRecord{key: ctx.Key(), headers: ctx.Headers(), value: rawMessage}
+	if src.topic == string(ctx.Topic()) && src.partition == ctx.Partition() && src.offset == ctx.Offset() {
+		return rec
+	}
+
+	msg, err := readRecord(ctx.Context(), proc.client, src.topic, src.partition, src.offset)
+	if err == nil && (msg == nil || msg.Offset != src.offset) {
+		err = fmt.Errorf("no record found at %s/%d@%d", src.topic, src.partition, src.offset)
+	}
+
+	if err != nil {
+		log.WithField("projection", proc.projection.Name).Warnf("unable to read the source record of a failed event: %s", err)
+		return rec
+	}
+	return inputRecord{key: string(msg.Key), headers: goka.HeadersFromSarama(msg.Headers), value: msg.Value}
+}
+
+func (proc *Processor) deadLetterEdges(p *projections.Projection) ([]goka.Edge, error) {
+	if p.ErrorPolicy() != projections.ErrorPolicyDeadLetter {
+		return nil, nil
+	}
+
+	output, err := proc.defineOutput(p.DeadLetterStream())
+	if err != nil {
+		return nil, err
+	}
+	return []goka.Edge{output}, nil
+}
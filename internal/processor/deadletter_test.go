@@ -0,0 +1,114 @@
+package processor
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/lovoo/goka"
+	"github.com/lovoo/goka/tester"
+	"github.com/ostafen/hermes/internal/projections"
+	"github.com/ostafen/hermes/internal/registry"
+	"github.com/stretchr/testify/require"
+)
+
+func errorPolicyQuery(policy string) string {
+	return `options({ errorPolicy: "` + policy + `" })
+		fromStream("orders").
+		when({
+			$init: () => ({ count: 0 }),
+			Added: (s, e) => {
+				if (e.body.fail) throw new Error("failed")
+				s.count += 1
+			}
+		})`
+}
+
+func countOf(t *testing.T, tt *tester.Tester) any {
+	state, err := decodeState(tt.TableValue(goka.GroupTable(goka.Group(groupName("test"))), projections.GlobalPartition))
+	require.NoError(t, err)
+	return state
+}
+
+func TestErrorPolicySkip(t *testing.T) {
+	proc, tt := newTestProcessor(t, errorPolicyQuery("skip"))
+
+	tt.Consume("orders", "", eventRecord(t, "Added", map[string]any{}))
+	tt.Consume("orders", "", eventRecord(t, "Added", map[string]any{"fail": true}))
+	tt.Consume("orders", "", []byte("not an event"))
+	tt.Consume("orders", "", eventRecord(t, "Added", map[string]any{}))
+
+	require.NoError(t, proc.Err())
+	require.Equal(t, map[string]any{"count": float64(2)}, countOf(t, tt))
+}
+
+// gokaContext lets failContext embed goka.Context, whose Context method would clash with the name of the field.
+type gokaContext = goka.Context
+
+// failContext is the context of a record of the orders stream, recording the error the callback fails with.
+type failContext struct {
+	gokaContext
+	err error
+}
+
+func (c *failContext) Topic() goka.Stream    { return "orders" }
+func (c *failContext) Partition() int32      { return 0 }
+func (c *failContext) Offset() int64         { return 0 }
+func (c *failContext) Headers() goka.Headers { return nil }
+
+func (c *failContext) Fail(err error) {
+	c.err = err
+	panic(err)
+}
+
+func TestErrorPolicyFail(t *testing.T) {
+	// the goka tester can't go on once a processor stops, so the error policy is applied to a context of its own
+	handle := func(query string, err error) error {
+		p, compileErr := projections.Compile("test", query)
+		require.NoError(t, compileErr)
+
+		ctx := &failContext{}
+		func() {
+			defer func() { _ = recover() }()
+			(&Processor{projection: p}).handleFailure(ctx, p, StageProcess, nil, err)
+		}()
+		return ctx.err
+	}
+
+	failed := errors.New("failed")
+	require.ErrorIs(t, handle(errorPolicyQuery("fail"), failed), failed)
+	require.NoError(t, handle(errorPolicyQuery("skip"), failed))
+
+	// outages of the schema registry stop the processor whatever the policy
+	unavailable := &registry.Error{StatusCode: http.StatusServiceUnavailable}
+	require.ErrorIs(t, handle(errorPolicyQuery("skip"), unavailable), unavailable)
+}
+
+func TestErrorPolicyDeadLetter(t *testing.T) {
+	proc, tt := newTestProcessor(t, errorPolicyQuery("deadLetter"))
+
+	deadLetters := tt.NewQueueTracker(proc.projection.DeadLetterStream())
+
+	tt.Consume("orders", "", eventRecord(t, "Added", map[string]any{}))
+	tt.Consume("orders", "order-1", []byte("not an event"), tester.WithHeaders(goka.Headers{"trace": []byte("t1")}))
+	tt.Consume("orders", "", eventRecord(t, "Added", map[string]any{}))
+
+	require.NoError(t, proc.Err())
+	require.Equal(t, map[string]any{"count": float64(2)}, countOf(t, tt))
+
+	headers, key, value, ok := deadLetters.NextRawWithHeaders()
+	require.True(t, ok)
+
+	// the failed record is written as it was read, along with the failure
+	require.Equal(t, "order-1", key)
+	require.Equal(t, []byte("not an event"), value)
+	require.Equal(t, []byte("t1"), headers["trace"])
+	require.Contains(t, string(headers[HeaderKeyError]), "invalid character")
+	require.Equal(t, string(StagePartition), string(headers[HeaderKeyStage]))
+	require.Equal(t, "orders", string(headers[HeaderKeyTopic]))
+	require.Equal(t, "0", string(headers[HeaderKeyPartition]))
+	require.Equal(t, "1", string(headers[HeaderKeyOffset]))
+
+	_, _, _, ok = deadLetters.NextRawWithHeaders()
+	require.False(t, ok)
+}
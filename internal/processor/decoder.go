@@ -0,0 +1,151 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ostafen/hermes/internal/event"
+	"github.com/ostafen/hermes/internal/projections"
+	"github.com/ostafen/hermes/internal/registry"
+)
+
+// Decoder turns the value of a record read from an input stream into an event.
+type Decoder interface {
+	Decode(ctx context.Context, value []byte) (event.EventData, error)
+}
+
+// Names of the built-in decoders. The avro and protobuf decoders are available when a schema registry is configured.
+const (
+	DecoderJson     = "json"
+	DecoderAvro     = "avro"
+	DecoderProtobuf = "protobuf"
+)
+
+var (
+	ErrUnknownDecoder         = errors.New("unknown decoder")
+	ErrSchemaRegistryRequired = errors.New("a schema registry is required to encode results")
+	errUnexpectedSchemaType   = errors.New("unexpected schema type")
+)
+
+// jsonDecoder decodes records holding the JSON envelope of an event.
+type jsonDecoder struct{}
+
+func (jsonDecoder) Decode(_ context.Context, value []byte) (event.EventData, error) {
+	var data event.EventData
+	err := json.Unmarshal(value, &data)
+	return data, err
+}
+
+// registryDecoder decodes records in the schema registry wire format, whose schema must be of the given type.
+// The type of events is the full name of the type of the record, such as an Avro record or a protobuf message.
+type registryDecoder struct {
+	client     *registry.Client
+	schemaType registry.SchemaType
+}
+
+func (d registryDecoder) Decode(ctx context.Context, value []byte) (event.EventData, error) {
+	rec, err := d.client.Decode(ctx, value)
+	if err != nil {
+		return event.EventData{}, err
+	}
+
+	if rec.Schema.Type != d.schemaType {
+		return event.EventData{}, fmt.Errorf("%w: expected %s, got %s", errUnexpectedSchemaType, d.schemaType, rec.Schema.Type)
+	}
+
+	return event.EventData{
+		ContentType: event.ContentTypeJson,
+		Metadata:    event.Metadata{event.MetadataKeyEventType: rec.Name},
+		Data:        rec.Value,
+	}, nil
+}
+
+// buildDecoders returns the decoders available to projections: the built-in ones, along with the ones of cfg.
+func buildDecoders(cfg Config) map[string]Decoder {
+	decoders := map[string]Decoder{
+		DecoderJson: jsonDecoder{},
+	}
+
+	if cfg.SchemaRegistry != nil {
+		decoders[DecoderAvro] = registryDecoder{client: cfg.SchemaRegistry, schemaType: registry.SchemaTypeAvro}
+		decoders[DecoderProtobuf] = registryDecoder{client: cfg.SchemaRegistry, schemaType: registry.SchemaTypeProtobuf}
+	}
+
+	for name, d := range cfg.Decoders {
+		decoders[name] = d
+	}
+	return decoders
+}
+
+// checkCodecs makes sure the decoders, the input mappings and the result encoding required by a projection are available.
+func (proc *Processor) checkCodecs(p *projections.Projection) error {
+	for stream, name := range p.Options.Decoders {
+		if _, has := proc.decoders[name]; !has {
+			return fmt.Errorf("%w %q for stream %s", ErrUnknownDecoder, name, stream)
+		}
+	}
+
+	if err := checkInputs(p.Options.Inputs); err != nil {
+		return err
+	}
+
+	if err := checkInputs(proc.cfg.Inputs); err != nil {
+		return err
+	}
+
+	if p.Options.ResultSubject != "" && proc.cfg.SchemaRegistry == nil {
+		return ErrSchemaRegistryRequired
+	}
+	return nil
+}
+
+// decode decodes a record read from stream, returning the event along with its JSON envelope,
+// which is what the partition stages forward to the main one.
+// Records of streams with an input mapping are decoded by decodeRecord.
+func (proc *Processor) decode(ctx context.Context, p *projections.Projection, stream string, rec inputRecord) ([]byte, event.EventData, error) {
+	name := p.DecoderOf(stream)
+	if name == "" {
+		name = DecoderJson
+	}
+
+	d, has := proc.decoders[name]
+	if !has {
+		return nil, event.EventData{}, fmt.Errorf("%w %q", ErrUnknownDecoder, name)
+	}
+
+	var data event.EventData
+	var err error
+
+	// a decoder failing on a malformed record must not stop the processor, which is up to the error policy
+	m, isRaw := proc.inputOf(p, stream)
+	if panicErr := catchPanic(func() {
+		if isRaw {
+			data, err = decodeRecord(ctx, d, m, rec)
+		} else {
+			data, err = d.Decode(ctx, rec.value)
+		}
+	}); panicErr != nil {
+		err = fmt.Errorf("error decoding record: %w", panicErr)
+	}
+
+	if err != nil {
+		return nil, event.EventData{}, err
+	}
+
+	if _, isJson := d.(jsonDecoder); isJson && !isRaw {
+		return rec.value, data, nil
+	}
+
+	raw, err := json.Marshal(data)
+	return raw, data, err
+}
+
+// encodeOutput encodes the output of a projection as a result record.
+func (proc *Processor) encodeOutput(ctx context.Context, p *projections.Projection, output any, causation event.Metadata) ([]byte, error) {
+	if p.Options.ResultSubject != "" {
+		return proc.cfg.SchemaRegistry.Encode(ctx, p.Options.ResultSubject, output)
+	}
+	return json.Marshal(withMetadata(newOutputEvent(output), causation)) // TODO: Remove NaN values from output
+}
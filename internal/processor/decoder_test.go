@@ -0,0 +1,148 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lovoo/goka"
+	"github.com/ostafen/hermes/internal/event"
+	"github.com/ostafen/hermes/internal/projections"
+	"github.com/ostafen/hermes/internal/registry"
+	"github.com/stretchr/testify/require"
+)
+
+const userSchema = `{"type":"record","name":"User","namespace":"com.example","fields":[{"name":"id","type":"long"},{"name":"name","type":"string"}]}`
+
+func TestDecode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/schemas/ids/1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"schema": userSchema})
+	}))
+	defer server.Close()
+
+	cfg := Config{SchemaRegistry: registry.NewClient(server.URL, server.Client())}
+	proc := &Processor{cfg: cfg, decoders: buildDecoders(cfg)}
+
+	p, err := projections.Compile("test", `options({ decoders: { users: "avro", "*": "json" } })
+	fromStreams("users", "orders").when({ $any: (s, e) => e.body })`)
+	require.NoError(t, err)
+	require.NoError(t, proc.checkCodecs(p))
+
+	// the user with id = 1 and name = "ab"
+	raw, data, err := proc.decode(context.Background(), p, "users", inputRecord{value: []byte{0, 0, 0, 0, 1, 0x02, 0x04, 'a', 'b'}})
+	require.NoError(t, err)
+	require.Equal(t, "com.example.User", data.Metadata.EventType())
+	require.Equal(t, map[string]any{"id": int64(1), "name": "ab"}, data.Data)
+
+	var forwarded event.EventData
+	require.NoError(t, json.Unmarshal(raw, &forwarded))
+	require.Equal(t, "com.example.User", forwarded.Metadata.EventType())
+	require.Equal(t, map[string]any{"id": float64(1), "name": "ab"}, forwarded.Data)
+
+	value := []byte(`{"metadata":{"type":"OrderPlaced"},"data":{"id":1}}`)
+	raw, data, err = proc.decode(context.Background(), p, "orders", inputRecord{value: value})
+	require.NoError(t, err)
+	require.Equal(t, value, raw)
+	require.Equal(t, "OrderPlaced", data.Metadata.EventType())
+
+	_, _, err = proc.decode(context.Background(), p, "users", inputRecord{value: value})
+	require.ErrorIs(t, err, registry.ErrNotWireFormat)
+}
+
+func TestDecodeRecord(t *testing.T) {
+	cfg := Config{
+		Inputs: map[string]projections.InputMapping{
+			"payments": {Type: "PaymentReceived", EventId: "$key"},
+			"*":        {Type: "header:ce_type"},
+		},
+	}
+	proc := &Processor{cfg: cfg, decoders: buildDecoders(cfg)}
+
+	p, err := projections.Compile("test", `options({
+		inputs: {
+			orders: { type: "$.kind", eventId: "header:id", metadata: { customer: "$.customer['id']", sku: "$.items[0].sku" } }
+		}
+	})
+	fromStreams("orders", "payments", "shipments").when({ $any: (s, e) => e.body })`)
+	require.NoError(t, err)
+	require.NoError(t, proc.checkCodecs(p))
+
+	ctx := context.Background()
+
+	value := []byte(`{"kind":"OrderPlaced","customer":{"id":7},"items":[{"sku":"a-1"}]}`)
+	raw, data, err := proc.decode(ctx, p, "orders", inputRecord{key: "o-1", headers: goka.Headers{"id": []byte("e-1")}, value: value})
+	require.NoError(t, err)
+	require.Equal(t, "OrderPlaced", data.Metadata.EventType())
+	require.Equal(t, "e-1", data.EventID)
+	require.Equal(t, "7", data.Metadata["customer"])
+	require.Equal(t, "a-1", data.Metadata["sku"])
+	require.True(t, data.IsJson())
+
+	var forwarded event.EventData
+	require.NoError(t, json.Unmarshal(raw, &forwarded))
+	require.Equal(t, data.Metadata, forwarded.Metadata)
+	require.Equal(t, "e-1", forwarded.EventID)
+	require.Equal(t, map[string]any{"kind": "OrderPlaced", "customer": map[string]any{"id": float64(7)}, "items": []any{map[string]any{"sku": "a-1"}}}, forwarded.Data)
+
+	_, _, err = proc.decode(ctx, p, "orders", inputRecord{value: []byte(`{"customer":{"id":7}}`)})
+	require.ErrorIs(t, err, ErrEventTypeNotFound)
+
+	// the mappings of the configuration apply to the streams the projection doesn't map
+	_, data, err = proc.decode(ctx, p, "payments", inputRecord{key: "p-1", value: []byte{0xff, 0x00}})
+	require.NoError(t, err)
+	require.Equal(t, "PaymentReceived", data.Metadata.EventType())
+	require.Equal(t, "p-1", data.EventID)
+	require.False(t, data.IsJson())
+	require.Equal(t, "/wA=", data.Data)
+
+	_, data, err = proc.decode(ctx, p, "shipments", inputRecord{headers: goka.Headers{"ce_type": []byte("Shipped")}, value: []byte(`"s-1"`)})
+	require.NoError(t, err)
+	require.Equal(t, "Shipped", data.Metadata.EventType())
+	require.Equal(t, "s-1", data.Data)
+}
+
+// panicDecoder fails as a decoder with a bug would, on a malformed record.
+type panicDecoder struct{}
+
+func (panicDecoder) Decode(context.Context, []byte) (event.EventData, error) {
+	var record []byte
+	_ = record[4]
+	return event.EventData{}, nil
+}
+
+func TestDecodePanic(t *testing.T) {
+	cfg := Config{Decoders: map[string]Decoder{"custom": panicDecoder{}}}
+	proc := &Processor{cfg: cfg, decoders: buildDecoders(cfg)}
+
+	p, err := projections.Compile("test", `options({ decoders: { users: "custom" } })
+	fromStream("users").when({ $any: (s, e) => e.body })`)
+	require.NoError(t, err)
+
+	_, _, err = proc.decode(context.Background(), p, "users", inputRecord{value: []byte{0}})
+	require.ErrorContains(t, err, "index out of range")
+}
+
+func TestCheckCodecs(t *testing.T) {
+	proc := &Processor{decoders: buildDecoders(Config{})}
+
+	p, err := projections.Compile("test", `options({ decoders: { users: "avro" } })
+	fromStream("users").when({ $any: (s, e) => e.body })`)
+	require.NoError(t, err)
+	require.ErrorIs(t, proc.checkCodecs(p), ErrUnknownDecoder)
+
+	p, err = projections.Compile("test", `options({ resultSubject: "users-result" })
+	fromStream("users").when({ $any: (s, e) => e.body })`)
+	require.NoError(t, err)
+	require.ErrorIs(t, proc.checkCodecs(p), ErrSchemaRegistryRequired)
+
+	p, err = projections.Compile("test", `options({ inputs: { users: { type: "$.names[first]" } } })
+	fromStream("users").when({ $any: (s, e) => e.body })`)
+	require.NoError(t, err)
+	require.ErrorIs(t, proc.checkCodecs(p), ErrInvalidSelector)
+}
@@ -0,0 +1,149 @@
+package processor
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/lovoo/goka"
+	"github.com/ostafen/hermes/internal/event"
+	"github.com/ostafen/hermes/internal/projections"
+)
+
+// emitOutputs writes the events emitted by emit() and linkTo().
+// goka requires the outputs of a processor to be declared when it is built, while the streams written by handlers
+// are only known at runtime, so these events are written by a producer of their own, created on demand,
+// or by the transactional producer of the main processor in exactly-once mode.
+type emitOutputs struct {
+	mtx      sync.Mutex
+	streams  map[string]bool
+	producer goka.Producer
+	txn      *txnProducer
+}
+
+// producerFor creates stream if it was not written yet, and returns the producer writing to it.
+// Streams are recorded in the emitted streams topic of the projection before being written, so that they can be deleted along with it.
+func (proc *Processor) producerFor(stream string) (goka.Producer, error) {
+	o := &proc.emits
+
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	if !o.streams[stream] {
+		if err := proc.tpm.EnsureStreamExists(stream, proc.cfg.Partitions); err != nil {
+			return nil, err
+		}
+
+		if err := proc.recordEmittedStream(stream); err != nil {
+			return nil, err
+		}
+
+		if o.streams == nil {
+			o.streams = make(map[string]bool)
+		}
+		o.streams[stream] = true
+	}
+
+	if o.txn != nil {
+		return o.txn, nil
+	}
+	return proc.plainProducer()
+}
+
+// plainProducer returns the non-transactional producer of emitted events, creating it on demand.
+// proc.emits.mtx must be held.
+func (proc *Processor) plainProducer() (goka.Producer, error) {
+	o := &proc.emits
+	if o.producer == nil {
+		producer, err := goka.NewProducer(proc.cfg.Brokers, kafkaCfg)
+		if err != nil {
+			return nil, err
+		}
+		o.producer = producer
+	}
+	return o.producer, nil
+}
+
+// recordEmittedStream writes stream to the emitted streams topic of the projection, keyed by its name.
+func (proc *Processor) recordEmittedStream(stream string) error {
+	topic := emittedStreamsTopic(proc.projection.Name)
+	if err := proc.tpm.EnsureTableExists(topic, 1); err != nil {
+		return err
+	}
+
+	producer, err := proc.plainProducer()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	producer.Emit(topic, stream, []byte{}).Then(func(err error) {
+		done <- err
+	})
+	return <-done
+}
+
+// close closes the producer of emitted events, if any.
+func (o *emitOutputs) close() error {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	if o.producer == nil {
+		return nil
+	}
+
+	err := o.producer.Close()
+	o.producer = nil
+	return err
+}
+
+// isOwnOutput reports whether stream is always an output of the main processor.
+func (proc *Processor) isOwnOutput(stream string) bool {
+	p := proc.projection
+
+	switch {
+	case stream == p.ResultStream():
+		return true
+	case stream == p.StateStream():
+		return p.OutputsState()
+	case stream == p.DeadLetterStream():
+		return p.ErrorPolicy() == projections.ErrorPolicyDeadLetter
+	}
+	return false
+}
+
+// emitEvents writes the events emitted while processing the current record.
+// The events written to streams other than the outputs of the main processor are written asynchronously,
+// and the offset of the record is committed once they are.
+func (proc *Processor) emitEvents(ctx goka.Context, emitted []projections.EmittedEvent, causation event.Metadata, headers goka.Headers) error {
+	for _, e := range emitted {
+		data, err := json.Marshal(withMetadata(newEmittedEvent(e), causation))
+		if err != nil {
+			return err
+		}
+
+		// events are keyed by their stream, so that the events of a stream keep their order
+		if proc.isOwnOutput(e.StreamId) {
+			ctx.Emit(goka.Stream(e.StreamId), e.StreamId, data, goka.WithCtxEmitHeaders(headers))
+			continue
+		}
+
+		producer, err := proc.producerFor(e.StreamId)
+		if err != nil {
+			return err
+		}
+
+		done := ctx.DeferCommit()
+		producer.EmitWithHeaders(e.StreamId, e.StreamId, data, headers).Then(done)
+	}
+	return nil
+}
+
+func newEmittedEvent(e projections.EmittedEvent) event.EventData {
+	data := newEvent(e.Type, e.Body)
+	for k, v := range e.Metadata {
+		if k != event.MetadataKeyEventType {
+			data.Metadata[k] = v
+		}
+	}
+	return data
+}
@@ -0,0 +1,476 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/lovoo/goka"
+	"github.com/lovoo/goka/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultCommitInterval = 100 * time.Millisecond
+
+// ErrFenced stops a processor in exactly-once mode whose partitions were assigned to another member of the group
+// while it was processing them: its transaction is aborted, while its local state may hold the effects of the transaction,
+// so it must be started again to recover the state from the group table.
+var ErrFenced = errors.New("the partitions of the processor were assigned to another member of the group")
+
+// txnProducer is a goka producer writing the records emitted by a processor in Kafka transactions,
+// together with the offsets of the input records they originate from.
+// Since the group table, the loop topic and the output streams are all written through the producer,
+// either all the effects of an input record are committed, or the record is processed again after a failure.
+type txnProducer struct {
+	id       string
+	group    string
+	interval time.Duration
+	client   sarama.Client
+	onError  func(error)
+
+	// topicManager builds the topic managers of the processor, see committedTopicManagerBuilder.
+	topicManager goka.TopicManagerBuilder
+
+	// callbacks hold the read lock while processing a record,
+	// so that a transaction is never committed halfway through the records emitted by a callback.
+	mtx sync.RWMutex
+
+	txnMtx   sync.Mutex
+	producer sarama.AsyncProducer
+	inTxn    bool
+	offsets  map[string]map[int32]int64
+	crashed  bool
+
+	// session is the consumer group session the records of the current transaction are processed in.
+	session sarama.ConsumerGroupSession
+
+	wg   sync.WaitGroup
+	stop chan struct{}
+}
+
+func (proc *Processor) newTxnProducer(group string) *txnProducer {
+	if !proc.cfg.ExactlyOnce {
+		return nil
+	}
+
+	return &txnProducer{
+		id:           group + "-" + proc.cfg.InstanceID,
+		group:        group,
+		interval:     proc.cfg.CommitInterval,
+		client:       proc.client,
+		topicManager: goka.TopicManagerBuilderWithTopicManagerConfig(topicManagerConfig(proc.cfg)),
+		onError: func(err error) {
+			proc.setErr(err)
+			proc.cancel()
+		},
+	}
+}
+
+// wrap makes cb process records within the current transaction. It returns cb as is if t is nil.
+func (t *txnProducer) wrap(cb goka.ProcessCallback) goka.ProcessCallback {
+	if t == nil {
+		return cb
+	}
+
+	return func(ctx goka.Context, msg any) {
+		t.mtx.RLock()
+		defer t.mtx.RUnlock()
+
+		// a failed callback stops the processor: its transaction is aborted, so that the records emitted so far
+		// are discarded and the input records are processed again.
+		defer func() {
+			if r := recover(); r != nil {
+				t.txnMtx.Lock()
+				t.crashed = true
+				t.txnMtx.Unlock()
+				panic(r)
+			}
+		}()
+
+		if err := t.begin(); err != nil {
+			ctx.Fail(err)
+		}
+
+		cb(ctx, msg)
+		t.markConsumed(ctx.Topic(), ctx.Partition(), ctx.Offset())
+	}
+}
+
+func (t *txnProducer) begin() error {
+	t.txnMtx.Lock()
+	defer t.txnMtx.Unlock()
+
+	if t.inTxn {
+		return nil
+	}
+
+	if err := t.producer.BeginTxn(); err != nil {
+		return err
+	}
+	t.inTxn = true
+	return nil
+}
+
+func (t *txnProducer) markConsumed(topic goka.Stream, partition int32, offset int64) {
+	t.txnMtx.Lock()
+	defer t.txnMtx.Unlock()
+
+	partitions := t.offsets[string(topic)]
+	if partitions == nil {
+		partitions = make(map[int32]int64)
+		t.offsets[string(topic)] = partitions
+	}
+	partitions[partition] = offset + 1
+}
+
+// commit commits the current transaction, if any, together with the offsets of the records it originates from.
+func (t *txnProducer) commit() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.txnMtx.Lock()
+	defer t.txnMtx.Unlock()
+
+	if !t.inTxn || t.crashed {
+		return nil
+	}
+
+	offsets := make(map[string][]*sarama.PartitionOffsetMetadata, len(t.offsets))
+	for topic, partitions := range t.offsets {
+		for partition, offset := range partitions {
+			offsets[topic] = append(offsets[topic], &sarama.PartitionOffsetMetadata{
+				Partition: partition,
+				Offset:    offset,
+			})
+		}
+	}
+
+	err := t.producer.AddOffsetsToTxn(offsets, t.group)
+	if err == nil {
+		err = t.checkGeneration()
+	}
+
+	if err == nil {
+		err = t.producer.CommitTxn()
+	}
+
+	if err != nil && (errors.Is(err, ErrFenced) || t.producer.TxnStatus()&sarama.ProducerTxnFlagAbortableError != 0) {
+		if abortErr := t.producer.AbortTxn(); abortErr != nil {
+			log.WithField("group", t.group).Warn(abortErr)
+		}
+	}
+
+	t.inTxn = false
+	t.offsets = make(map[string]map[int32]int64)
+	return err
+}
+
+// checkGeneration makes sure the member of the group which processed the records of the current transaction still belongs
+// to the current generation of the group, so that a processor whose partitions were assigned to another member
+// while it was unresponsive can't commit the records the other member processes again.
+//
+// The group coordinator checks the generation of the offsets committed in transactions since KIP-447,
+// but sarama doesn't send the group metadata, so it is checked with a heartbeat before the transaction is committed.
+// A rebalance in progress doesn't end the generation: the partitions are only reassigned after the member commits and rejoins.
+func (t *txnProducer) checkGeneration() error {
+	if t.session == nil {
+		return ErrFenced
+	}
+
+	coordinator, err := t.client.Coordinator(t.group)
+	if err != nil {
+		return err
+	}
+
+	resp, err := coordinator.Heartbeat(&sarama.HeartbeatRequest{
+		GroupId:      t.group,
+		GenerationId: t.session.GenerationID(),
+		MemberId:     t.session.MemberID(),
+	})
+	if err != nil {
+		return err
+	}
+
+	switch resp.Err {
+	case sarama.ErrNoError, sarama.ErrRebalanceInProgress:
+		return nil
+	case sarama.ErrIllegalGeneration, sarama.ErrUnknownMemberId, sarama.ErrFencedInstancedId:
+		return fmt.Errorf("%w: %v", ErrFenced, resp.Err)
+	}
+	return resp.Err
+}
+
+func (t *txnProducer) setSession(session sarama.ConsumerGroupSession) {
+	t.txnMtx.Lock()
+	defer t.txnMtx.Unlock()
+
+	t.session = session
+}
+
+func (t *txnProducer) run() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := t.commit(); err != nil {
+			t.onError(fmt.Errorf("error committing transaction: %w", err))
+			return
+		}
+	}
+}
+
+// build implements goka.ProducerBuilder.
+func (t *txnProducer) build(brokers []string, clientID string, hasher func() hash.Hash32) (goka.Producer, error) {
+	config := *kafkaCfg
+	config.ClientID = clientID
+	config.Producer.Partitioner = sarama.NewCustomHashPartitioner(hasher)
+	config.Producer.Idempotent = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Transaction.ID = t.id
+	config.Net.MaxOpenRequests = 1
+
+	producer, err := sarama.NewAsyncProducer(brokers, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	t.producer = producer
+	t.inTxn = false
+	t.crashed = false
+	t.offsets = make(map[string]map[int32]int64)
+	t.stop = make(chan struct{})
+
+	t.wg.Add(3)
+	go t.run()
+	go t.resolve()
+	go t.reject()
+
+	return t, nil
+}
+
+func (t *txnProducer) resolve() {
+	defer t.wg.Done()
+
+	for msg := range t.producer.Successes() {
+		msg.Metadata.(goka.PromiseFinisher)(msg, nil)
+	}
+}
+
+func (t *txnProducer) reject() {
+	defer t.wg.Done()
+
+	for err := range t.producer.Errors() {
+		err.Msg.Metadata.(goka.PromiseFinisher)(err.Msg, err)
+	}
+}
+
+func (t *txnProducer) Emit(topic string, key string, value []byte) *goka.Promise {
+	return t.EmitWithHeaders(topic, key, value, nil)
+}
+
+func (t *txnProducer) EmitWithHeaders(topic string, key string, value []byte, headers goka.Headers) *goka.Promise {
+	promise, finish := goka.NewPromiseWithFinisher()
+
+	t.producer.Input() <- &sarama.ProducerMessage{
+		Topic:    topic,
+		Key:      sarama.StringEncoder(key),
+		Value:    sarama.ByteEncoder(value),
+		Headers:  headers.ToSarama(),
+		Metadata: finish,
+	}
+	return promise
+}
+
+// Close commits the last transaction and closes the producer.
+// After a failure, the transaction is aborted instead, as it would be by the next producer with the same transactional id.
+func (t *txnProducer) Close() error {
+	close(t.stop)
+
+	err := t.commit()
+
+	t.txnMtx.Lock()
+	if t.inTxn {
+		if abortErr := t.producer.AbortTxn(); abortErr != nil {
+			log.WithField("group", t.group).Warn(abortErr)
+		}
+		t.inTxn = false
+	}
+	t.txnMtx.Unlock()
+
+	if closeErr := t.producer.Close(); err == nil {
+		err = closeErr
+	}
+	t.wg.Wait()
+	return err
+}
+
+// options returns the goka options of a processor using t.
+func (t *txnProducer) options() []goka.ProcessorOption {
+	if t == nil {
+		return nil
+	}
+
+	config := committedConsumerConfig()
+	config.Consumer.Offsets.AutoCommit.Enable = false
+
+	return []goka.ProcessorOption{
+		goka.WithProducerBuilder(t.build),
+		goka.WithConsumerGroupBuilder(t.consumerGroupBuilder(config)),
+		goka.WithConsumerSaramaBuilder(goka.SaramaConsumerBuilderWithConfig(committedConsumerConfig())),
+		goka.WithTopicManagerBuilder(committedTopicManagerBuilder(t.client, t.topicManager)),
+		// the local storage may hold the effects of an aborted transaction, so tables are always recovered from Kafka
+		goka.WithStorageBuilder(storage.MemoryBuilder()),
+	}
+}
+
+func committedConsumerConfig() *sarama.Config {
+	config := *kafkaCfg
+	config.Consumer.IsolationLevel = sarama.ReadCommitted
+	return &config
+}
+
+func (t *txnProducer) consumerGroupBuilder(config *sarama.Config) goka.ConsumerGroupBuilder {
+	build := goka.ConsumerGroupBuilderWithConfig(config)
+
+	return func(brokers []string, group, clientID string) (sarama.ConsumerGroup, error) {
+		consumerGroup, err := build(brokers, group, clientID)
+		if err != nil {
+			return nil, err
+		}
+		return &txnConsumerGroup{ConsumerGroup: consumerGroup, txn: t}, nil
+	}
+}
+
+// txnConsumerGroup is a consumer group telling its sessions to a txnProducer,
+// and committing the current transaction when its partitions are revoked.
+type txnConsumerGroup struct {
+	sarama.ConsumerGroup
+	txn *txnProducer
+}
+
+func (g *txnConsumerGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	return g.ConsumerGroup.Consume(ctx, topics, &txnGroupHandler{ConsumerGroupHandler: handler, txn: g.txn})
+}
+
+type txnGroupHandler struct {
+	sarama.ConsumerGroupHandler
+	txn *txnProducer
+}
+
+func (h *txnGroupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	h.txn.setSession(session)
+	return h.ConsumerGroupHandler.Setup(session)
+}
+
+// Cleanup commits the records processed in the session once the processor stopped,
+// so that the members the partitions are assigned to start from the offsets following them.
+func (h *txnGroupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	err := h.ConsumerGroupHandler.Cleanup(session)
+
+	if commitErr := h.txn.commit(); err == nil && commitErr != nil {
+		err = fmt.Errorf("error committing transaction: %w", commitErr)
+	}
+
+	h.txn.setSession(nil)
+	return err
+}
+
+// committedTopicManagerBuilder wraps the topic managers built by build, for tables written in transactions.
+//
+// goka recovers a table by reading its topic until the record preceding the newest offset.
+// When the topic is written in transactions, that offset is a transaction marker or belongs to an aborted transaction,
+// and consumers reading committed records never receive it, so the newest offset reported
+// is the one following the last committed record instead.
+func committedTopicManagerBuilder(client sarama.Client, build goka.TopicManagerBuilder) goka.TopicManagerBuilder {
+	return func(brokers []string) (goka.TopicManager, error) {
+		tm, err := build(brokers)
+		if err != nil {
+			return nil, err
+		}
+		return &committedTopicManager{TopicManager: tm, client: client}, nil
+	}
+}
+
+type committedTopicManager struct {
+	goka.TopicManager
+	client sarama.Client
+}
+
+func (m *committedTopicManager) GetOffset(topic string, partition int32, time int64) (int64, error) {
+	if time != sarama.OffsetNewest {
+		return m.TopicManager.GetOffset(topic, partition, time)
+	}
+	return committedEnd(m.client, topic, partition)
+}
+
+// committedEndWindow is the number of offsets committedEnd looks for committed records in first.
+const committedEndWindow = 16
+
+// committedEnd returns the offset following the last committed record of a topic partition,
+// or its oldest offset if it holds no committed record.
+// The partition is read backwards, in windows doubling in size, since it usually ends with a few markers.
+func committedEnd(client sarama.Client, topic string, partition int32) (int64, error) {
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, err
+	}
+
+	end, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, err
+	}
+
+	for window := int64(committedEndWindow); end > oldest; window *= 2 {
+		from := end - window
+		if from < oldest {
+			from = oldest
+		}
+
+		msg, err := lastCommittedRecord(client, topic, partition, from, end)
+		if err != nil {
+			return 0, err
+		}
+
+		if msg != nil {
+			return msg.Offset + 1, nil
+		}
+		end = from
+	}
+	return oldest, nil
+}
+
+// lastCommittedRecord returns the last committed record of a topic partition between the offsets from and to, if any.
+func lastCommittedRecord(client sarama.Client, topic string, partition int32, from, to int64) (*sarama.ConsumerMessage, error) {
+	var last *sarama.ConsumerMessage
+
+	for offset := from; offset < to; {
+		res, err := fetchRecords(client, topic, partition, offset, sarama.ReadCommitted)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, msg := range res.records {
+			if msg.Offset < to {
+				last = msg
+			}
+		}
+
+		if res.next <= offset || res.next >= res.end {
+			break
+		}
+		offset = res.next
+	}
+	return last, nil
+}
@@ -0,0 +1,112 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+func newOffsetClient(t *testing.T, oldest, newest int64, responses ...*sarama.FetchResponse) sarama.Client {
+	fetches := make([]any, 0, len(responses))
+	for _, resp := range responses {
+		fetches = append(fetches, resp)
+	}
+
+	return newMockClient(t, sarama.ReadCommitted, func(*sarama.MockBroker) map[string]sarama.MockResponse {
+		return map[string]sarama.MockResponse{
+			"OffsetRequest": sarama.NewMockOffsetResponse(t).
+				SetOffset(linkedTopic, 0, sarama.OffsetOldest, oldest).
+				SetOffset(linkedTopic, 0, sarama.OffsetNewest, newest),
+			"FetchRequest": sarama.NewMockSequence(fetches...),
+		}
+	})
+}
+
+func TestCommittedEnd(t *testing.T) {
+	t.Run("records followed by markers", func(t *testing.T) {
+		resp := newFetchResponse(6)
+		resp.AddRecordBatch(linkedTopic, 0, sarama.StringEncoder("k"), sarama.StringEncoder("v"), 3, 7, true)
+		resp.AddControlRecord(linkedTopic, 0, 4, 7, sarama.ControlRecordCommit)
+		resp.AddControlRecord(linkedTopic, 0, 5, 8, sarama.ControlRecordCommit)
+
+		end, err := committedEnd(newOffsetClient(t, 0, 6, resp), linkedTopic, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(4), end)
+	})
+
+	t.Run("records before the first window", func(t *testing.T) {
+		markers := newFetchResponse(20)
+		markers.AddControlRecord(linkedTopic, 0, 19, 7, sarama.ControlRecordCommit)
+
+		records := newFetchResponse(20)
+		records.AddRecordBatch(linkedTopic, 0, sarama.StringEncoder("k"), sarama.StringEncoder("v"), 2, 7, true)
+		records.AddControlRecord(linkedTopic, 0, 3, 7, sarama.ControlRecordCommit)
+
+		end, err := committedEnd(newOffsetClient(t, 0, 20, markers, records), linkedTopic, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(3), end)
+	})
+
+	t.Run("aborted records", func(t *testing.T) {
+		resp := newFetchResponse(4)
+		resp.AddRecordBatch(linkedTopic, 0, sarama.StringEncoder("k"), sarama.StringEncoder("v"), 2, 7, true)
+		resp.AddControlRecord(linkedTopic, 0, 3, 7, sarama.ControlRecordAbort)
+		resp.GetBlock(linkedTopic, 0).AbortedTransactions = []*sarama.AbortedTransaction{{ProducerID: 7, FirstOffset: 2}}
+
+		end, err := committedEnd(newOffsetClient(t, 2, 4, resp), linkedTopic, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(2), end)
+	})
+
+	t.Run("empty partition", func(t *testing.T) {
+		end, err := committedEnd(newOffsetClient(t, 5, 5), linkedTopic, 0)
+		require.NoError(t, err)
+		require.Equal(t, int64(5), end)
+	})
+}
+
+const txnGroup = "txn-group"
+
+type groupSession struct {
+	sarama.ConsumerGroupSession
+}
+
+func (groupSession) GenerationID() int32 { return 3 }
+func (groupSession) MemberID() string    { return "member" }
+
+func TestCheckGeneration(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     sarama.KError
+		fenced  bool
+		session sarama.ConsumerGroupSession
+	}{
+		{name: "current generation", err: sarama.ErrNoError, session: groupSession{}},
+		{name: "rebalance in progress", err: sarama.ErrRebalanceInProgress, session: groupSession{}},
+		{name: "illegal generation", err: sarama.ErrIllegalGeneration, session: groupSession{}, fenced: true},
+		{name: "unknown member", err: sarama.ErrUnknownMemberId, session: groupSession{}, fenced: true},
+		{name: "no session", fenced: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newMockClient(t, sarama.ReadCommitted, func(broker *sarama.MockBroker) map[string]sarama.MockResponse {
+				return map[string]sarama.MockResponse{
+					"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+						SetCoordinator(sarama.CoordinatorGroup, txnGroup, broker),
+					"HeartbeatRequest": sarama.NewMockWrapper(&sarama.HeartbeatResponse{Err: test.err}),
+				}
+			})
+
+			txn := &txnProducer{group: txnGroup, client: client, session: test.session}
+
+			err := txn.checkGeneration()
+			if test.fenced {
+				require.ErrorIs(t, err, ErrFenced)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
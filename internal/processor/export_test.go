@@ -0,0 +1,35 @@
+package processor
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/lovoo/goka"
+)
+
+var errInjectedCrash = errors.New("injected crash")
+
+// InjectCrash makes the main stage of p fail after processing n events, without committing its open transaction.
+// The main stage is built again, so p must not be started yet.
+func InjectCrash(p *Processor, n int) error {
+	var left atomic.Int64
+	left.Store(int64(n))
+
+	p.wrapMain = func(cb goka.ProcessCallback) goka.ProcessCallback {
+		return func(ctx goka.Context, msg any) {
+			cb(ctx, msg)
+
+			if left.Add(-1) == 0 {
+				ctx.Fail(errInjectedCrash)
+			}
+		}
+	}
+
+	main, err := p.buildIputProcessor(p.projection)
+	if err != nil {
+		return err
+	}
+
+	p.mainProcessor = main
+	return nil
+}
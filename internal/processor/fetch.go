@@ -0,0 +1,140 @@
+package processor
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+const (
+	fetchMaxBytes = 1 << 20
+	fetchMaxWait  = 100 * time.Millisecond
+)
+
+var errLegacyRecords = errors.New("records in the legacy message format are not supported")
+
+// fetchResult holds the data records returned by a single fetch request.
+type fetchResult struct {
+	records []*sarama.ConsumerMessage
+	// next is the offset following the last fetched batch, which can differ from the offset following the last record,
+	// since batches of control records and aborted transactions are skipped.
+	next int64
+	// end is the high watermark of the partition, or its last stable offset when reading committed records.
+	end int64
+}
+
+// fetchRecords fetches the records of a topic partition starting at offset, with a single bounded request to its leader,
+// unlike consumers, which block until a record is available. Control records are skipped,
+// as well as the records of aborted transactions when the read committed isolation level is used.
+func fetchRecords(client sarama.Client, topic string, partition int32, offset int64, isolation sarama.IsolationLevel) (fetchResult, error) {
+	broker, err := client.Leader(topic, partition)
+	if err != nil {
+		return fetchResult{}, err
+	}
+
+	req := &sarama.FetchRequest{
+		Version:     4,
+		MaxWaitTime: int32(fetchMaxWait / time.Millisecond),
+		MinBytes:    1,
+		MaxBytes:    fetchMaxBytes,
+		Isolation:   isolation,
+	}
+	req.AddBlock(topic, partition, offset, fetchMaxBytes)
+
+	resp, err := broker.Fetch(req)
+	if err != nil {
+		return fetchResult{}, err
+	}
+
+	block := resp.GetBlock(topic, partition)
+	if block == nil {
+		return fetchResult{}, sarama.ErrIncompleteResponse
+	}
+
+	if !errors.Is(block.Err, sarama.ErrNoError) {
+		return fetchResult{}, block.Err
+	}
+
+	res := fetchResult{next: offset, end: block.HighWaterMarkOffset}
+	if isolation == sarama.ReadCommitted {
+		res.end = block.LastStableOffset
+	}
+
+	aborted := block.AbortedTransactions
+	sort.Slice(aborted, func(i, j int) bool {
+		return aborted[i].FirstOffset < aborted[j].FirstOffset
+	})
+
+	// producers whose current transaction was aborted, as in the sarama consumer
+	abortedProducers := make(map[int64]bool)
+
+	for _, records := range block.RecordsSet {
+		batch := records.RecordBatch
+		if batch == nil {
+			if records.MsgSet != nil {
+				return fetchResult{}, errLegacyRecords
+			}
+			continue
+		}
+
+		if batch.PartialTrailingRecord {
+			break
+		}
+
+		for len(aborted) > 0 && aborted[0].FirstOffset <= batch.LastOffset() {
+			abortedProducers[aborted[0].ProducerID] = true
+			aborted = aborted[1:]
+		}
+
+		if batch.LastOffset() >= res.next {
+			res.next = batch.LastOffset() + 1
+		}
+
+		if batch.Control {
+			if len(batch.Records) > 0 && isAbortMarker(batch.Records[0]) {
+				delete(abortedProducers, batch.ProducerID)
+			}
+			continue
+		}
+
+		if isolation == sarama.ReadCommitted && batch.IsTransactional && abortedProducers[batch.ProducerID] {
+			continue
+		}
+
+		for _, rec := range batch.Records {
+			msgOffset := batch.FirstOffset + rec.OffsetDelta
+			if msgOffset < offset {
+				continue
+			}
+			res.records = append(res.records, consumerMessage(topic, partition, batch, rec))
+		}
+	}
+	return res, nil
+}
+
+// isAbortMarker reports whether a control record marks the abort of a transaction.
+// Its key holds a version and the type of the marker, 0 standing for abort.
+func isAbortMarker(rec *sarama.Record) bool {
+	return len(rec.Key) >= 4 && binary.BigEndian.Uint16(rec.Key[2:4]) == 0
+}
+
+func consumerMessage(topic string, partition int32, batch *sarama.RecordBatch, rec *sarama.Record) *sarama.ConsumerMessage {
+	timestamp := batch.FirstTimestamp.Add(rec.TimestampDelta)
+	if batch.LogAppendTime {
+		timestamp = batch.MaxTimestamp
+	}
+
+	return &sarama.ConsumerMessage{
+		Topic:          topic,
+		Partition:      partition,
+		Offset:         batch.FirstOffset + rec.OffsetDelta,
+		Key:            rec.Key,
+		Value:          rec.Value,
+		Headers:        rec.Headers,
+		Timestamp:      timestamp,
+		BlockTimestamp: batch.MaxTimestamp,
+	}
+}
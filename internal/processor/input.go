@@ -0,0 +1,269 @@
+package processor
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/lovoo/goka"
+	"github.com/ostafen/hermes/internal/event"
+	"github.com/ostafen/hermes/internal/projections"
+)
+
+// Prefixes of the selectors of input mappings. Selectors without a known prefix are constants.
+const (
+	selectorHeaderPrefix = "header:"
+	selectorKey          = "$key"
+	selectorJsonPath     = "$"
+)
+
+const contentTypeBinary event.ContentType = "application/octet-stream"
+
+var (
+	ErrInvalidSelector   = errors.New("invalid selector")
+	ErrEventTypeNotFound = errors.New("event type not found")
+)
+
+// inputRecord is a record read from an input stream.
+type inputRecord struct {
+	key     string
+	headers goka.Headers
+	value   []byte
+}
+
+// inputOf returns the input mapping of the records of stream, if any.
+// The mappings of the projection take precedence over the ones of the configuration.
+func (proc *Processor) inputOf(p *projections.Projection, stream string) (projections.InputMapping, bool) {
+	if m, has := p.InputOf(stream); has {
+		return m, true
+	}
+
+	if m, has := proc.cfg.Inputs[stream]; has {
+		return m, true
+	}
+	m, has := proc.cfg.Inputs[projections.AnyStream]
+	return m, has
+}
+
+// checkInputs makes sure the selectors of input mappings are valid.
+func checkInputs(inputs map[string]projections.InputMapping) error {
+	for stream, m := range inputs {
+		selectors := []string{m.Type, m.EventId}
+		for _, s := range m.Metadata {
+			selectors = append(selectors, s)
+		}
+
+		for _, s := range selectors {
+			if _, err := parseSelector(s); err != nil {
+				return fmt.Errorf("%w for stream %s: %s", err, stream, s)
+			}
+		}
+	}
+	return nil
+}
+
+// decodeRecord builds the event of a record which doesn't hold an envelope, as told by its input mapping.
+// Records are decoded by d, unless it is the JSON decoder, whose envelope they lack: their value is the body as is.
+func decodeRecord(ctx context.Context, d Decoder, m projections.InputMapping, rec inputRecord) (event.EventData, error) {
+	var data event.EventData
+	var err error
+
+	if _, isJson := d.(jsonDecoder); isJson {
+		data, err = bodyOf(rec.value, event.ContentType(m.ContentType))
+	} else {
+		data, err = d.Decode(ctx, rec.value)
+	}
+
+	if err != nil {
+		return event.EventData{}, err
+	}
+
+	if data.Metadata == nil {
+		data.Metadata = event.Metadata{}
+	}
+
+	for key, s := range m.Metadata {
+		if v, err := selectValue(s, rec, data.Data); err != nil {
+			return event.EventData{}, err
+		} else if v != "" {
+			data.Metadata[key] = v
+		}
+	}
+
+	if m.EventId != "" {
+		if data.EventID, err = selectValue(m.EventId, rec, data.Data); err != nil {
+			return event.EventData{}, err
+		}
+	}
+
+	if m.Type != "" {
+		eventType, err := selectValue(m.Type, rec, data.Data)
+		if err != nil {
+			return event.EventData{}, err
+		}
+		data.Metadata[event.MetadataKeyEventType] = eventType
+	}
+
+	if data.Metadata.EventType() == "" {
+		return event.EventData{}, ErrEventTypeNotFound
+	}
+	return data, nil
+}
+
+// bodyOf returns the event whose body is value.
+// As in envelopes, JSON bodies are carried as is, text as a string, and binary data base64 encoded.
+func bodyOf(value []byte, contentType event.ContentType) (event.EventData, error) {
+	if contentType == "" {
+		contentType = contentTypeBinary
+		if json.Valid(value) {
+			contentType = event.ContentTypeJson
+		}
+	}
+
+	data := event.EventData{ContentType: contentType, RawData: value}
+	if data.IsJson() {
+		err := json.Unmarshal(value, &data.Data)
+		return data, err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(string(contentType))
+	if strings.HasPrefix(mediaType, "text/") {
+		data.Data = string(value)
+	} else {
+		data.Data = base64.StdEncoding.EncodeToString(value)
+	}
+	return data, nil
+}
+
+// pathStep is a step of a JSON path: either the name of a property or the index of an array element.
+type pathStep struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+// selector is a parsed selector of an input mapping.
+type selector struct {
+	header   string
+	isHeader bool
+	isKey    bool
+	path     []pathStep
+	isPath   bool
+	constant string
+}
+
+func parseSelector(s string) (selector, error) {
+	switch {
+	case strings.HasPrefix(s, selectorHeaderPrefix):
+		return selector{header: strings.TrimPrefix(s, selectorHeaderPrefix), isHeader: true}, nil
+	case s == selectorKey:
+		return selector{isKey: true}, nil
+	case strings.HasPrefix(s, selectorJsonPath):
+		path, err := parseJsonPath(s)
+		return selector{path: path, isPath: true}, err
+	}
+	return selector{constant: s}, nil
+}
+
+// parseJsonPath parses a JSON path made of property names and array indexes, such as $.items[0].sku or $['type'].
+func parseJsonPath(s string) ([]pathStep, error) {
+	rest := strings.TrimPrefix(s, selectorJsonPath)
+
+	var path []pathStep
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+
+			n := strings.IndexAny(rest, ".[")
+			if n < 0 {
+				n = len(rest)
+			}
+			if n == 0 {
+				return nil, ErrInvalidSelector
+			}
+			path = append(path, pathStep{name: rest[:n]})
+			rest = rest[n:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, ErrInvalidSelector
+			}
+
+			step, err := parseBracketStep(rest[1:end])
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, step)
+			rest = rest[end+1:]
+		default:
+			return nil, ErrInvalidSelector
+		}
+	}
+	return path, nil
+}
+
+func parseBracketStep(s string) (pathStep, error) {
+	if len(s) >= 2 && (s[0] == '\'' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return pathStep{name: s[1 : len(s)-1]}, nil
+	}
+
+	index, err := strconv.Atoi(s)
+	if err != nil || index < 0 {
+		return pathStep{}, ErrInvalidSelector
+	}
+	return pathStep{index: index, isIndex: true}, nil
+}
+
+// selectValue returns the value selected by s from a record, whose body is given.
+// It returns an empty string if the header or the path doesn't exist.
+func selectValue(s string, rec inputRecord, body any) (string, error) {
+	sel, err := parseSelector(s)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case sel.isHeader:
+		return string(rec.headers[sel.header]), nil
+	case sel.isKey:
+		return rec.key, nil
+	case sel.isPath:
+		return selectPath(sel.path, body)
+	}
+	return sel.constant, nil
+}
+
+func selectPath(path []pathStep, v any) (string, error) {
+	for _, step := range path {
+		switch x := v.(type) {
+		case map[string]any:
+			if step.isIndex {
+				return "", nil
+			}
+			v = x[step.name]
+		case []any:
+			if !step.isIndex || step.index >= len(x) {
+				return "", nil
+			}
+			v = x[step.index]
+		default:
+			return "", nil
+		}
+	}
+
+	switch x := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return x, nil
+	}
+
+	data, err := json.Marshal(v)
+	return string(data), err
+}
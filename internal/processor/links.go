@@ -0,0 +1,106 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/lovoo/goka"
+	"github.com/ostafen/hermes/internal/event"
+	"github.com/ostafen/hermes/internal/projections"
+)
+
+var ErrLinkTargetNotFound = errors.New("link target not found")
+
+// linkTarget is the event a link event points to.
+type linkTarget struct {
+	raw    []byte
+	data   event.EventData
+	source eventSource
+}
+
+// resolveLink fetches the event a link event points to.
+// The metadata of the link event is kept in the source of the target, if the projection includes links.
+func (proc *Processor) resolveLink(ctx goka.Context, p *projections.Projection, in event.EventData) (*linkTarget, error) {
+	data, err := json.Marshal(in.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	var link projections.Link
+	if err := json.Unmarshal(data, &link); err != nil {
+		return nil, fmt.Errorf("invalid link event: %w", err)
+	}
+
+	msg, err := readRecord(ctx.Context(), proc.client, link.StreamId, link.Partition, link.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	// the target offset can be a transaction marker or a compacted record, in which case the next record is read
+	if msg == nil || msg.Offset != link.Offset || msg.Value == nil {
+		return nil, fmt.Errorf("%w: %s/%d@%d", ErrLinkTargetNotFound, link.StreamId, link.Partition, link.Offset)
+	}
+
+	headers := goka.HeadersFromSarama(msg.Headers)
+
+	rec := inputRecord{key: string(msg.Key), headers: headers, value: msg.Value}
+	raw, targetData, err := proc.decode(ctx.Context(), p, link.StreamId, rec)
+	if err != nil {
+		return nil, err
+	}
+
+	target := &linkTarget{
+		raw:  raw,
+		data: targetData,
+		source: eventSource{
+			topic:     link.StreamId,
+			partition: link.Partition,
+			offset:    link.Offset,
+			// the headers of the target are exposed, as its metadata is
+			recordHeaders: userHeaders(headers),
+		},
+	}
+
+	if p.IncludesLinks() {
+		metadata, err := json.Marshal(in.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		target.source.linkMetadata = string(metadata)
+	}
+	return target, nil
+}
+
+// readRecord reads the first record of a topic partition at or after offset, skipping transaction markers.
+// It returns nil if the partition has no such record.
+func readRecord(ctx context.Context, client sarama.Client, topic string, partition int32, offset int64) (*sarama.ConsumerMessage, error) {
+	isolation := client.Config().Consumer.IsolationLevel
+
+	for {
+		res, err := fetchRecords(client, topic, partition, offset, isolation)
+		if errors.Is(err, sarama.ErrOffsetOutOfRange) {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(res.records) > 0 {
+			return res.records[0], nil
+		}
+
+		// the fetched batches held no data record, or the end of the partition was reached
+		if res.next <= offset || res.next >= res.end {
+			return nil, nil
+		}
+		offset = res.next
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package processor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/require"
+)
+
+const linkedTopic = "linked-stream"
+
+// newFetchClient returns a client of a mock broker leading linkedTopic, which answers fetch requests with responses.
+func newFetchClient(t *testing.T, isolation sarama.IsolationLevel, responses ...*sarama.FetchResponse) sarama.Client {
+	fetches := make([]any, 0, len(responses))
+	for _, resp := range responses {
+		fetches = append(fetches, resp)
+	}
+
+	return newMockClient(t, isolation, func(*sarama.MockBroker) map[string]sarama.MockResponse {
+		return map[string]sarama.MockResponse{
+			"FetchRequest": sarama.NewMockSequence(fetches...),
+		}
+	})
+}
+
+// newMockClient returns a client of a mock broker leading linkedTopic, which answers requests with the handlers built by handlers.
+func newMockClient(t *testing.T, isolation sarama.IsolationLevel, handlers func(*sarama.MockBroker) map[string]sarama.MockResponse) sarama.Client {
+	broker := sarama.NewMockBroker(t, 1)
+	t.Cleanup(broker.Close)
+
+	handlerMap := handlers(broker)
+	handlerMap["MetadataRequest"] = sarama.NewMockMetadataResponse(t).
+		SetBroker(broker.Addr(), broker.BrokerID()).
+		SetLeader(linkedTopic, 0, broker.BrokerID())
+	handlerMap["ApiVersionsRequest"] = sarama.NewMockApiVersionsResponse(t)
+	broker.SetHandlerByMap(handlerMap)
+
+	conf := sarama.NewConfig()
+	conf.Version = sarama.V2_4_0_0
+	conf.Consumer.IsolationLevel = isolation
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, conf)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func newFetchResponse(end int64) *sarama.FetchResponse {
+	resp := &sarama.FetchResponse{Version: 4}
+	resp.AddError(linkedTopic, 0, sarama.ErrNoError)
+
+	block := resp.GetBlock(linkedTopic, 0)
+	block.HighWaterMarkOffset = end
+	block.LastStableOffset = end
+	return resp
+}
+
+func TestReadRecord(t *testing.T) {
+	t.Run("record at offset", func(t *testing.T) {
+		resp := newFetchResponse(3)
+		resp.AddRecordBatch(linkedTopic, 0, sarama.StringEncoder("k1"), sarama.StringEncoder("v1"), 1, 0, false)
+		resp.AddRecordBatch(linkedTopic, 0, sarama.StringEncoder("k2"), sarama.StringEncoder("v2"), 2, 0, false)
+
+		msg, err := readRecord(context.Background(), newFetchClient(t, sarama.ReadUncommitted, resp), linkedTopic, 0, 1)
+		require.NoError(t, err)
+		require.NotNil(t, msg)
+		require.Equal(t, int64(1), msg.Offset)
+		require.Equal(t, "k1", string(msg.Key))
+		require.Equal(t, "v1", string(msg.Value))
+	})
+
+	t.Run("records before offset are skipped", func(t *testing.T) {
+		resp := newFetchResponse(3)
+		resp.AddRecord(linkedTopic, 0, sarama.StringEncoder("k0"), sarama.StringEncoder("v0"), 0)
+		resp.AddRecord(linkedTopic, 0, sarama.StringEncoder("k1"), sarama.StringEncoder("v1"), 1)
+		resp.AddRecord(linkedTopic, 0, sarama.StringEncoder("k2"), sarama.StringEncoder("v2"), 2)
+		resp.SetLastOffsetDelta(linkedTopic, 0, 2)
+
+		msg, err := readRecord(context.Background(), newFetchClient(t, sarama.ReadUncommitted, resp), linkedTopic, 0, 2)
+		require.NoError(t, err)
+		require.NotNil(t, msg)
+		require.Equal(t, int64(2), msg.Offset)
+	})
+
+	t.Run("transaction marker", func(t *testing.T) {
+		resp := newFetchResponse(6)
+		resp.AddControlRecord(linkedTopic, 0, 4, 7, sarama.ControlRecordCommit)
+		resp.AddRecordBatch(linkedTopic, 0, nil, sarama.StringEncoder("v5"), 5, 0, false)
+
+		msg, err := readRecord(context.Background(), newFetchClient(t, sarama.ReadUncommitted, resp), linkedTopic, 0, 4)
+		require.NoError(t, err)
+		require.NotNil(t, msg)
+		require.Equal(t, int64(5), msg.Offset)
+	})
+
+	t.Run("marker at the end of a response", func(t *testing.T) {
+		markers := newFetchResponse(6)
+		markers.AddControlRecord(linkedTopic, 0, 4, 7, sarama.ControlRecordCommit)
+
+		records := newFetchResponse(6)
+		records.AddRecordBatch(linkedTopic, 0, nil, sarama.StringEncoder("v5"), 5, 0, false)
+
+		msg, err := readRecord(context.Background(), newFetchClient(t, sarama.ReadUncommitted, markers, records), linkedTopic, 0, 4)
+		require.NoError(t, err)
+		require.NotNil(t, msg)
+		require.Equal(t, int64(5), msg.Offset)
+	})
+
+	t.Run("marker at the end of the partition", func(t *testing.T) {
+		resp := newFetchResponse(5)
+		resp.AddControlRecord(linkedTopic, 0, 4, 7, sarama.ControlRecordCommit)
+
+		msg, err := readRecord(context.Background(), newFetchClient(t, sarama.ReadUncommitted, resp), linkedTopic, 0, 4)
+		require.NoError(t, err)
+		require.Nil(t, msg)
+	})
+
+	t.Run("end of the partition", func(t *testing.T) {
+		msg, err := readRecord(context.Background(), newFetchClient(t, sarama.ReadUncommitted, newFetchResponse(5)), linkedTopic, 0, 5)
+		require.NoError(t, err)
+		require.Nil(t, msg)
+	})
+
+	t.Run("offset out of range", func(t *testing.T) {
+		resp := &sarama.FetchResponse{Version: 4}
+		resp.AddError(linkedTopic, 0, sarama.ErrOffsetOutOfRange)
+
+		msg, err := readRecord(context.Background(), newFetchClient(t, sarama.ReadUncommitted, resp), linkedTopic, 0, 100)
+		require.NoError(t, err)
+		require.Nil(t, msg)
+	})
+
+	t.Run("aborted transaction", func(t *testing.T) {
+		resp := newFetchResponse(4)
+		resp.AddRecordBatch(linkedTopic, 0, nil, sarama.StringEncoder("aborted"), 1, 7, true)
+		resp.AddControlRecord(linkedTopic, 0, 2, 7, sarama.ControlRecordAbort)
+		resp.AddRecordBatch(linkedTopic, 0, nil, sarama.StringEncoder("committed"), 3, 8, true)
+
+		block := resp.GetBlock(linkedTopic, 0)
+		block.AbortedTransactions = []*sarama.AbortedTransaction{{ProducerID: 7, FirstOffset: 1}}
+
+		msg, err := readRecord(context.Background(), newFetchClient(t, sarama.ReadCommitted, resp), linkedTopic, 0, 1)
+		require.NoError(t, err)
+		require.NotNil(t, msg)
+		require.Equal(t, int64(3), msg.Offset)
+		require.Equal(t, "committed", string(msg.Value))
+	})
+}
@@ -0,0 +1,45 @@
+package processor
+
+import (
+	"sync"
+
+	"github.com/lovoo/goka"
+	"github.com/ostafen/hermes/internal/projections"
+)
+
+// instancePool holds an instance of the projection for each goka partition of the processors,
+// since goka consumes every partition in its own goroutine, while javascript runtimes are not safe for concurrent use.
+type instancePool struct {
+	projection *projections.Projection
+	instances  sync.Map
+}
+
+type instanceKey struct {
+	group     goka.Group
+	partition int32
+}
+
+func newInstancePool(p *projections.Projection) *instancePool {
+	return &instancePool{projection: p}
+}
+
+// get returns the instance of a goka partition, compiling it the first time the partition is consumed.
+func (pool *instancePool) get(group goka.Group, partition int32) (*projections.Projection, error) {
+	key := instanceKey{group: group, partition: partition}
+
+	if inst, has := pool.instances.Load(key); has {
+		return inst.(*projections.Projection), nil
+	}
+
+	inst, err := pool.projection.Fork()
+	if err != nil {
+		return nil, err
+	}
+
+	actual, _ := pool.instances.LoadOrStore(key, inst)
+	return actual.(*projections.Projection), nil
+}
+
+func (proc *Processor) instance(ctx goka.Context) (*projections.Projection, error) {
+	return proc.instances.get(ctx.Group(), ctx.Partition())
+}
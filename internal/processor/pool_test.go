@@ -0,0 +1,75 @@
+package processor
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lovoo/goka"
+	"github.com/ostafen/hermes/internal/projections"
+)
+
+const benchmarkQuery = `fromStream("orders").partitionBy(e => e.body.customer).when({
+	$init: () => ({ count: 0, total: 0 }),
+	OrderPlaced: (s, e) => {
+		s.count++
+		s.total += e.body.amount
+	}
+})`
+
+// BenchmarkInstancePool processes events concurrently, as goka does with the partitions of a topic,
+// each partition using its own instance of the projection. Throughput scales with the number of partitions, up to GOMAXPROCS.
+func BenchmarkInstancePool(b *testing.B) {
+	p, err := projections.Compile("benchmark", benchmarkQuery)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	e := projections.Event{
+		IsJson: true,
+		Type:   "OrderPlaced",
+		Body:   map[string]any{"customer": "c1", "amount": 10},
+	}
+
+	for _, partitions := range []int{1, 2, 4, 8, 16, 24} {
+		b.Run(fmt.Sprintf("partitions=%d", partitions), func(b *testing.B) {
+			pool := newInstancePool(p)
+			group := goka.Group(groupName(p.Name))
+
+			// compile the instances up front, as it happens only once per partition
+			for i := 0; i < partitions; i++ {
+				if _, err := pool.get(group, int32(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ResetTimer()
+			start := time.Now()
+
+			var wg sync.WaitGroup
+			for i := 0; i < partitions; i++ {
+				n := b.N / partitions
+				if i < b.N%partitions {
+					n++
+				}
+
+				wg.Add(1)
+				go func(partition int32, n int) {
+					defer wg.Done()
+
+					inst, _ := pool.get(group, partition)
+
+					var state any
+					for j := 0; j < n; j++ {
+						inst.GetPartition(e)
+						state = inst.Update(state, e).State
+					}
+				}(int32(i), n)
+			}
+			wg.Wait()
+
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "events/s")
+		})
+	}
+}
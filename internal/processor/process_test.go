@@ -0,0 +1,226 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/lovoo/goka"
+	"github.com/lovoo/goka/tester"
+	"github.com/ostafen/hermes/internal/event"
+	"github.com/ostafen/hermes/internal/projections"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestProcessor runs the partition and main stages of a projection on a goka tester,
+// as well as the view over the group table of bi-state projections.
+// Errors stopping the stages are reported by the Err method of the processor.
+func newTestProcessor(t *testing.T, query string) (*Processor, *tester.Tester) {
+	p, err := projections.Compile("test", query)
+	require.NoError(t, err)
+
+	tt := tester.New(t)
+
+	cfg := Config{Partitions: 1, StoragePath: InMemoryStorage}
+	proc := &Processor{
+		cfg:             cfg,
+		tpm:             tester.NewMockTopicManager(tt, 1, 1),
+		projection:      p,
+		stages:          make(map[string]*partitionStage),
+		instances:       newInstancePool(p),
+		decoders:        buildDecoders(cfg),
+		gokaOptions:     []goka.ProcessorOption{goka.WithTester(tt)},
+		gokaViewOptions: []goka.ViewOption{goka.WithViewTester(tt)},
+	}
+
+	proc.emits.producer, err = tt.ProducerBuilder()(nil, "", nil)
+	require.NoError(t, err)
+
+	stage, err := proc.buildPartitionProcessor(p, partitionByGroupName(p.Name), p.InputStreams, nil)
+	require.NoError(t, err)
+
+	main, err := proc.buildIputProcessor(p)
+	require.NoError(t, err)
+
+	var ctx context.Context
+	ctx, proc.cancel = context.WithCancel(context.Background())
+
+	if p.IsBiState() {
+		require.NoError(t, proc.runSharedStateView(ctx))
+	}
+
+	for _, gp := range []*goka.Processor{stage, main} {
+		proc.wg.Add(1)
+		go func(gp *goka.Processor) {
+			defer proc.wg.Done()
+
+			if err := gp.Run(ctx); err != nil {
+				proc.setErr(err)
+			}
+		}(gp)
+	}
+
+	t.Cleanup(func() {
+		proc.cancel()
+		proc.WaitShutdown()
+	})
+	return proc, tt
+}
+
+func eventRecord(t *testing.T, eventType string, body any) []byte {
+	data, err := json.Marshal(event.EventData{
+		EventID:  eventType + "-id",
+		Metadata: event.Metadata{event.MetadataKeyEventType: eventType},
+		Data:     body,
+	})
+	require.NoError(t, err)
+	return data
+}
+
+// outputRecord is a record written to an output stream.
+type outputRecord struct {
+	key     string
+	headers goka.Headers
+	event   event.EventData
+}
+
+// readOutputs returns the records of the stream of tracker which were not read yet.
+func readOutputs(t *testing.T, tracker *tester.QueueTracker) []outputRecord {
+	var records []outputRecord
+	for {
+		headers, key, value, ok := tracker.NextRawWithHeaders()
+		if !ok {
+			return records
+		}
+
+		var data event.EventData
+		require.NoError(t, json.Unmarshal(value, &data))
+		records = append(records, outputRecord{key: key, headers: headers, event: data})
+	}
+}
+
+func TestStateStream(t *testing.T) {
+	proc, tt := newTestProcessor(t, `fromStream("orders").
+		partitionBy(e => e.body.customer).
+		when({
+			$init: () => ({ count: 0 }),
+			Added: (s, e) => { s.count += 1 }
+		}).
+		transformBy(s => ({ total: s.count })).
+		filterBy(s => s.total != 2).
+		outputState()`)
+
+	states := tt.NewQueueTracker(proc.projection.StateStream())
+
+	for _, customer := range []string{"c1", "c1", "c2", "c1"} {
+		tt.Consume("orders", "", eventRecord(t, "Added", map[string]any{"customer": customer}))
+	}
+	require.NoError(t, proc.Err())
+
+	type state struct {
+		key   string
+		total float64
+	}
+
+	// the second update of c1 is filtered out
+	var published []state
+	for _, rec := range readOutputs(t, states) {
+		require.Equal(t, EventTypeProjectionState, rec.event.Metadata.EventType())
+		require.Equal(t, "Added-id", rec.event.Metadata[MetadataKeyCausationId])
+
+		total, _ := rec.event.Data.(map[string]any)["total"].(float64)
+		published = append(published, state{key: rec.key, total: total})
+	}
+	require.Equal(t, []state{{"c1", 1}, {"c2", 1}, {"c1", 3}}, published)
+
+	// the stored state is not transformed
+	stored, err := decodeState(tt.TableValue(goka.GroupTable(goka.Group(groupName("test"))), "c1"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"count": float64(3)}, stored)
+}
+
+func TestPropagation(t *testing.T) {
+	proc, tt := newTestProcessor(t, `fromStream("orders").
+		when({
+			$init: () => ({ count: 0 }),
+			Added: (s, e) => {
+				s.count += 1
+				emit("audit", "Counted", { count: s.count })
+			}
+		}).
+		outputState()`)
+
+	results := tt.NewQueueTracker(proc.projection.ResultStream())
+	states := tt.NewQueueTracker(proc.projection.StateStream())
+	emitted := tt.NewQueueTracker("audit")
+
+	data, err := json.Marshal(event.EventData{
+		EventID: "e1",
+		Metadata: event.Metadata{
+			event.MetadataKeyEventType: "Added",
+			MetadataKeyCorrelationId:   "c1",
+		},
+		Data: map[string]any{},
+	})
+	require.NoError(t, err)
+
+	tt.Consume("orders", "", data, tester.WithHeaders(goka.Headers{"trace": []byte("t1")}))
+	require.NoError(t, proc.Err())
+
+	for stream, tracker := range map[string]*tester.QueueTracker{"result": results, "state": states, "emitted": emitted} {
+		records := readOutputs(t, tracker)
+		require.Len(t, records, 1, stream)
+
+		rec := records[0]
+
+		// the headers of the input record are kept, while the internal ones are not exposed
+		require.Equal(t, goka.Headers{
+			"trace":                  []byte("t1"),
+			MetadataKeyCorrelationId: []byte("c1"),
+			MetadataKeyCausationId:   []byte("e1"),
+		}, rec.headers, stream)
+
+		require.Equal(t, "c1", rec.event.Metadata[MetadataKeyCorrelationId], stream)
+		require.Equal(t, "e1", rec.event.Metadata[MetadataKeyCausationId], stream)
+	}
+}
+
+func TestEmit(t *testing.T) {
+	proc, tt := newTestProcessor(t, `fromStream("orders").
+		when({
+			Added: (s, e) => {
+				emit("audit", "Counted", {})
+				linkTo("projections-test-result", e)
+			}
+		})`)
+
+	results := tt.NewQueueTracker(proc.projection.ResultStream())
+	emitted := tt.NewQueueTracker("audit")
+	streams := tt.NewQueueTracker(emittedStreamsTopic("test"))
+
+	tt.Consume("orders", "", eventRecord(t, "Added", map[string]any{}))
+	tt.Consume("orders", "", eventRecord(t, "Added", map[string]any{}))
+	require.NoError(t, proc.Err())
+
+	// events are keyed by the stream they are written to
+	for _, rec := range readOutputs(t, emitted) {
+		require.Equal(t, "audit", rec.key)
+	}
+
+	var links int
+	for _, rec := range readOutputs(t, results) {
+		if rec.event.Metadata.EventType() == projections.LinkEventType {
+			require.Equal(t, proc.projection.ResultStream(), rec.key)
+			links++
+		}
+	}
+	require.Equal(t, 2, links)
+
+	// streams other than the outputs of the projection are recorded once, to be deleted along with it
+	_, stream, _, ok := streams.NextRawWithHeaders()
+	require.True(t, ok)
+	require.Equal(t, "audit", stream)
+
+	_, _, _, ok = streams.NextRawWithHeaders()
+	require.False(t, ok)
+}
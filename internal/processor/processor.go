@@ -3,10 +3,14 @@ package processor
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/google/uuid"
@@ -15,7 +19,7 @@ import (
 	"github.com/lovoo/goka/storage"
 	"github.com/ostafen/hermes/internal/event"
 	"github.com/ostafen/hermes/internal/projections"
-	log "github.com/sirupsen/logrus"
+	"github.com/ostafen/hermes/internal/registry"
 )
 
 func init() {
@@ -31,15 +35,47 @@ func initGoka() {
 }
 
 type Config struct {
-	Brokers     []string
-	Replication int
-	Partitions  int
-	StoragePath string
+	Brokers      []string
+	Replication  int
+	Partitions   int
+	StoragePath  string
+	MinFreeSpace uint64
+
+	// DiscoveryInterval is how often the streams of projections using a dynamic selector, such as fromAll(), are rescanned.
+	DiscoveryInterval time.Duration
+	// InternalStreams are never selected by dynamic selectors.
+	InternalStreams []string
+	// ExcludeStream reports whether a stream must not be selected by dynamic selectors.
+	ExcludeStream func(stream string) bool
+
+	// ExactlyOnce makes processors write their outputs and commit their input offsets in Kafka transactions.
+	ExactlyOnce bool
+	// CommitInterval is how often transactions are committed when ExactlyOnce is enabled.
+	CommitInterval time.Duration
+	// InstanceID identifies this instance of the service when ExactlyOnce is enabled, naming the transactional ids of its processors.
+	// It must be unique among the running instances, and stay the same across restarts, so that the transactions
+	// left open by a crashed instance are aborted once it is back. Defaults to the hostname.
+	InstanceID string
+
+	// SchemaRegistry, if set, provides the avro and protobuf decoders, and encodes results with the resultSubject option.
+	SchemaRegistry *registry.Client
+	// Decoders are the decoders projections can select, besides the built-in ones.
+	Decoders map[string]Decoder
+	// Inputs are the input mappings of streams whose records don't hold the envelope of an event,
+	// which the inputs option of projections takes precedence over.
+	Inputs map[string]projections.InputMapping
 }
 
+var (
+	ErrStateNotReady      = errors.New("projection state is not ready")
+	ErrExactlyOnceReorder = errors.New("reorderEvents is not supported in exactly-once mode")
+)
+
 const (
 	DefaultReplicationFactor = 3
 	DefaultPartitions        = 1
+	DefaultMinFreeSpace      = 100 << 20
+	DefaultDiscoveryInterval = 30 * time.Second
 	InMemoryStorage          = ":in-memory:"
 )
 
@@ -49,23 +85,46 @@ func DefaultConfig(brokers []string) Config {
 		replication = len(brokers)
 	}
 
+	hostname, _ := os.Hostname()
+
 	return Config{
-		Brokers:     brokers,
-		Replication: replication,
-		Partitions:  DefaultPartitions,
+		Brokers:           brokers,
+		Replication:       replication,
+		Partitions:        DefaultPartitions,
+		MinFreeSpace:      DefaultMinFreeSpace,
+		DiscoveryInterval: DefaultDiscoveryInterval,
+		CommitInterval:    DefaultCommitInterval,
+		InstanceID:        hostname,
 	}
 }
 
 type Processor struct {
 	cfg Config
 
-	client             sarama.Client
-	wg                 sync.WaitGroup
-	tpm                goka.TopicManager
-	mainProcessor      *goka.Processor
-	partitionProcessor *goka.Processor
+	mtx          sync.Mutex
+	err          error
+	cancel       func()
+	inputStreams []string
+
+	client        sarama.Client
+	wg            sync.WaitGroup
+	tpm           goka.TopicManager
+	projection    *projections.Projection
+	mainProcessor *goka.Processor
+	stagesMtx     sync.Mutex
+	stages        map[string]*partitionStage
+	view          *goka.View
+	emits         emitOutputs
+	instances     *instancePool
+	decoders      map[string]Decoder
+	// gokaOptions and gokaViewOptions are added to the options of every goka processor and view, such as the tester used by unit tests.
+	gokaOptions     []goka.ProcessorOption
+	gokaViewOptions []goka.ViewOption
+	// wrapMain, if set, wraps the callback of the main stage, such as the crashes tests inject.
+	wrapMain func(goka.ProcessCallback) goka.ProcessCallback
 }
 
+// BuildProcessor builds the processor of a projection, which must be closed once it is no longer running.
 func BuildProcessor(p *projections.Projection, cfg Config) (*Processor, error) {
 	client, err := sarama.NewClient(cfg.Brokers, kafkaCfg)
 	if err != nil {
@@ -74,44 +133,61 @@ func BuildProcessor(p *projections.Projection, cfg Config) (*Processor, error) {
 
 	tpm, err := newTopicManager(cfg)
 	if err != nil {
+		client.Close()
 		return nil, err
 	}
 
 	processor := &Processor{
-		cfg:    cfg,
-		client: client,
-		tpm:    tpm,
+		cfg:        cfg,
+		client:     client,
+		tpm:        tpm,
+		projection: p,
+		stages:     make(map[string]*partitionStage),
+		instances:  newInstancePool(p),
+		decoders:   buildDecoders(cfg),
 	}
 
-	if err := processor.inheritConfigFromInputStreams(p.InputStreams); err != nil {
+	if err := processor.build(); err != nil {
+		processor.Close()
 		return nil, err
 	}
+	return processor, nil
+}
 
-	var partitionProcessor *goka.Processor
-	if p.IsPartitioned() {
-		partitionProcessor, err = processor.buildPartitionProcessor(p)
+func (processor *Processor) build() error {
+	p, cfg := processor.projection, processor.cfg
+
+	if err := processor.checkCodecs(p); err != nil {
+		return err
 	}
 
+	stages, err := resolveStages(processor.client, cfg, p)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	inputStreams := p.InputStreams
-	if p.IsPartitioned() {
-		inputStreams = []string{
-			partitionByTopic(p.Name),
-		}
+	if err := processor.inheritConfigFromInputStreams(stageStreams(stages)); err != nil {
+		return err
 	}
 
-	mainProcessor, err := processor.buildIputProcessor(p, inputStreams)
+	if cfg.ExactlyOnce && p.ReordersEvents() {
+		return ErrExactlyOnceReorder
+	}
 
-	processor.mainProcessor = mainProcessor
-	processor.partitionProcessor = partitionProcessor
+	mainProcessor, err := processor.buildIputProcessor(p)
+	if err != nil {
+		return err
+	}
 
-	return processor, err
+	processor.mainProcessor = mainProcessor
+	return nil
 }
 
 func (p *Processor) inheritConfigFromInputStreams(topics []string) error {
+	if len(topics) == 0 {
+		return nil
+	}
+
 	b := p.client.Brokers()[0]
 	b, err := p.client.Broker(b.ID())
 	if err != nil {
@@ -151,41 +227,171 @@ func (p *Processor) inheritConfigFromInputStreams(topics []string) error {
 func (p *Processor) run(ctx context.Context, proc *goka.Processor) error {
 	p.wg.Add(1)
 
-	var err error
 	go func() {
 		defer p.wg.Done()
 
-		err = proc.Run(ctx)
+		if err := proc.Run(ctx); err != nil {
+			p.setErr(err)
+			p.cancel()
+		}
 	}()
 
 	if err := proc.WaitForReadyContext(ctx); err != nil {
 		return err
 	}
-	return err
+	return p.Err()
 }
 
+// Start runs the underlying goka processors until ctx is canceled.
+// If any of them fails, the others are stopped too and the error is reported by Err.
 func (p *Processor) Start(ctx context.Context) error {
-	err := p.run(ctx, p.mainProcessor)
+	ctx, p.cancel = context.WithCancel(ctx)
+
+	var err error
+
+	biState := p.projection.IsBiState()
+	if biState {
+		err = p.runSharedStateView(ctx)
+	}
+
+	if err == nil {
+		err = p.run(ctx, p.mainProcessor)
+	}
+
+	if err == nil {
+		err = p.startStages(ctx)
+	}
 
-	if err == nil && p.partitionProcessor != nil {
-		return p.run(ctx, p.partitionProcessor)
+	if err == nil && !biState {
+		err = p.runView(ctx)
+	}
+
+	if err != nil {
+		p.cancel()
 	}
 	return err
 }
 
+// runView starts a view over the group table, which serves state queries.
+// The table is created by the main processor, so the view can only be built once it is running,
+// unless the table is created beforehand, as for bi-state projections.
+func (p *Processor) runView(ctx context.Context) error {
+	view, err := goka.NewView(p.cfg.Brokers,
+		goka.GroupTable(goka.Group(groupName(p.projection.Name))),
+		&codec.Bytes{},
+		p.viewOptions()...,
+	)
+	if err != nil {
+		return err
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		if err := view.Run(ctx); err != nil {
+			p.setErr(err)
+			p.cancel()
+		}
+	}()
+
+	p.mtx.Lock()
+	p.view = view
+	p.mtx.Unlock()
+
+	return nil
+}
+
+func (p *Processor) viewOptions() []goka.ViewOption {
+	opts := []goka.ViewOption{
+		goka.WithViewStorageBuilder(p.storageBuilder(groupName(p.projection.Name) + "-view")),
+	}
+
+	// the group table is written in transactions, so the view must skip aborted records and transaction markers
+	if p.cfg.ExactlyOnce {
+		opts = append(opts,
+			goka.WithViewConsumerSaramaBuilder(goka.SaramaConsumerBuilderWithConfig(committedConsumerConfig())),
+			goka.WithViewTopicManagerBuilder(committedTopicManagerBuilder(p.client, goka.TopicManagerBuilderWithTopicManagerConfig(topicManagerConfig(p.cfg)))),
+		)
+	}
+	return append(opts, p.gokaViewOptions...)
+}
+
+// GetState returns the state of the given partition, as read from the group table.
+// Use projections.GlobalPartition to get the state of a non-partitioned projection.
+func (p *Processor) GetState(partition string) (any, error) {
+	p.mtx.Lock()
+	view := p.view
+	p.mtx.Unlock()
+
+	if view == nil || !view.Recovered() {
+		return nil, ErrStateNotReady
+	}
+
+	val, err := view.Get(partition)
+	if err != nil {
+		return nil, err
+	}
+	return decodeState(val)
+}
+
+func (p *Processor) setErr(err error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+// Err returns the first error which caused the processor to stop, if any.
+func (p *Processor) Err() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.err
+}
+
 func (p *Processor) WaitReady(ctx context.Context) error {
-	err := p.mainProcessor.WaitForReadyContext(ctx)
+	if err := p.mainProcessor.WaitForReadyContext(ctx); err != nil {
+		return err
+	}
+
+	p.stagesMtx.Lock()
+	defer p.stagesMtx.Unlock()
 
-	if err == nil && p.partitionProcessor != nil {
-		return p.partitionProcessor.WaitForReadyContext(ctx)
+	for _, stage := range p.stages {
+		if err := stage.processor.WaitForReadyContext(ctx); err != nil {
+			return err
+		}
 	}
-	return err
+	return nil
+}
+
+// InputStreams returns the streams the processor is currently reading from.
+func (p *Processor) InputStreams() []string {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.inputStreams
 }
 
 func (p *Processor) WaitShutdown() {
 	p.wg.Wait()
 }
 
+// Close releases the connections of the processor, which must not be running.
+func (p *Processor) Close() error {
+	err := p.emits.close()
+	if cerr := p.tpm.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := p.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
 func newTopicManager(cfg Config) (goka.TopicManager, error) {
 	return goka.NewTopicManager(cfg.Brokers, kafkaCfg, topicManagerConfig(cfg))
 }
@@ -198,7 +404,11 @@ func topicManagerConfig(cfg Config) *goka.TopicManagerConfig {
 }
 
 func getState(ctx goka.Context) (any, error) {
-	val, _ := ctx.Value().([]byte)
+	return decodeState(ctx.Value())
+}
+
+func decodeState(v any) (any, error) {
+	val, _ := v.([]byte)
 
 	if val == nil {
 		return nil, nil
@@ -218,96 +428,299 @@ func setState(ctx goka.Context, state any) error {
 }
 
 const (
-	MetadataKeyTopicPartition = "topicPartition"
+	MetadataKeyTopicPartition = projections.MetadataKeyTopicPartition
 	MetadataKeyTimestamp      = "timestamp"
+	MetadataKeyCorrelationId  = "$correlationId"
+	MetadataKeyCausationId    = "$causationId"
+)
+
+// internalHeaderPrefix is the prefix of the headers set by hermes, which are not exposed to projections.
+const internalHeaderPrefix = "hermes-"
+
+const (
+	HeaderKeySourceTopic     = "hermes-source-topic"
+	HeaderKeySourcePartition = "hermes-source-partition"
+	HeaderKeySourceOffset    = "hermes-source-offset"
+	HeaderKeyLinkMetadata    = "hermes-link-metadata"
 )
 
+// eventSource is the record of an input stream an event was read from.
+type eventSource struct {
+	topic     string
+	partition int32
+	offset    int64
+
+	// linkMetadata is the metadata of the link event which was resolved to the record, if any.
+	linkMetadata string
+	// recordHeaders are the headers of the record, other than the ones set by hermes.
+	recordHeaders goka.Headers
+}
+
+// sourceOf returns the record an event was read from.
+// Events forwarded by the partition stages carry the source headers, since ctx refers to the partition-by topic.
+func sourceOf(ctx goka.Context) eventSource {
+	headers := ctx.Headers()
+
+	src := eventSource{
+		topic:         string(ctx.Topic()),
+		partition:     ctx.Partition(),
+		offset:        ctx.Offset(),
+		recordHeaders: userHeaders(headers),
+	}
+
+	topic, hasSource := headers[HeaderKeySourceTopic]
+	if !hasSource || !strings.HasSuffix(src.topic, partitionByTopicSuffix) {
+		return src
+	}
+
+	partition, err := strconv.ParseInt(string(headers[HeaderKeySourcePartition]), 10, 32)
+	if err != nil {
+		return src
+	}
+
+	offset, err := strconv.ParseInt(string(headers[HeaderKeySourceOffset]), 10, 64)
+	if err != nil {
+		return src
+	}
+
+	return eventSource{
+		topic:         string(topic),
+		partition:     int32(partition),
+		offset:        offset,
+		linkMetadata:  string(headers[HeaderKeyLinkMetadata]),
+		recordHeaders: src.recordHeaders,
+	}
+}
+
+// userHeaders returns the headers which were not set by hermes.
+func userHeaders(headers goka.Headers) goka.Headers {
+	res := make(goka.Headers, len(headers))
+	for k, v := range headers {
+		if !strings.HasPrefix(k, internalHeaderPrefix) {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func (src eventSource) headers() goka.Headers {
+	headers := goka.Headers{
+		HeaderKeySourceTopic:     []byte(src.topic),
+		HeaderKeySourcePartition: []byte(strconv.FormatInt(int64(src.partition), 10)),
+		HeaderKeySourceOffset:    []byte(strconv.FormatInt(src.offset, 10)),
+	}
+
+	if src.linkMetadata != "" {
+		headers[HeaderKeyLinkMetadata] = []byte(src.linkMetadata)
+	}
+	return src.recordHeaders.Merged(headers)
+}
+
 func NewEventFrom(ctx goka.Context, in event.EventData) projections.Event {
-	metadata := map[string]string{
-		MetadataKeyTopicPartition: strconv.FormatInt(int64(ctx.Partition()), 10),
-		MetadataKeyTimestamp:      strconv.FormatInt(ctx.Timestamp().UnixNano(), 10),
+	return newEventAt(ctx, sourceOf(ctx), in)
+}
+
+// newEventAt builds the event of a record read from src,
+// which is not the record of ctx for events forwarded by the partition stages or resolved from a link.
+// The headers of the record are exposed as metadata, which the metadata of the event takes precedence over.
+func newEventAt(ctx goka.Context, src eventSource, in event.EventData) projections.Event {
+	metadata := make(map[string]string, len(src.recordHeaders)+len(in.Metadata)+2)
+	for k, v := range src.recordHeaders {
+		metadata[k] = string(v)
 	}
 
+	metadata[MetadataKeyTopicPartition] = strconv.FormatInt(int64(src.partition), 10)
+	metadata[MetadataKeyTimestamp] = strconv.FormatInt(ctx.Timestamp().UnixNano(), 10)
+
 	for k, v := range in.Metadata {
 		metadata[k] = v
 	}
 
-	return projections.Event{
-		IsJson:         true,
-		Partition:      ctx.Key(),
-		SequenceNumber: ctx.Offset(),
-		Body:           in.Data,
-		Data:           in.Data,
-		MetadataRaw:    metadata,
-		StreamId:       string(ctx.Topic()),
-		Type:           in.Metadata.EventType(),
+	e := projections.Event{
+		EventId:         in.EventID,
+		IsJson:          in.IsJson(),
+		Partition:       ctx.Key(),
+		SequenceNumber:  src.offset,
+		BodyRaw:         string(in.RawData),
+		MetadataRaw:     metadata,
+		LinkMetadataRaw: src.linkMetadata,
+		StreamId:        src.topic,
+		Type:            in.Metadata.EventType(),
 	}
+
+	// handlers see the payload of non-JSON events only in bodyRaw, as the string carried by the envelope
+	if e.IsJson {
+		e.Body = in.Data
+		e.Data = in.Data
+	} else if raw, isString := in.Data.(string); isString {
+		e.BodyRaw = raw
+	}
+	return e
 }
 
-func (proc *Processor) buildIputProcessor(p *projections.Projection, streams []string) (*goka.Processor, error) {
+// buildIputProcessor builds the processor of the main stage, which reads the events keyed by partition by the partition stages.
+// Every event of a non-partitioned projection is keyed by projections.GlobalPartition, so that its state is global.
+func (proc *Processor) buildIputProcessor(p *projections.Projection) (*goka.Processor, error) {
+	txn := proc.newTxnProducer(groupName(p.Name))
+	proc.emits.txn = txn
+
 	cb := func(ctx goka.Context, msg any) {
-		rawMessage := msg.([]byte)
+		value, _ := msg.([]byte)
 
+		// events read from the partition-by topic are already decoded, and carry the record they were read from
 		var inData event.EventData
-		if err := json.Unmarshal(rawMessage, &inData); err != nil {
-			log.Error(err)
-			return
+		err := json.Unmarshal(value, &inData)
+		if err == nil {
+			err = proc.processEvent(ctx, p, inData, sourceOf(ctx))
 		}
 
-		e := NewEventFrom(ctx, inData)
+		if err != nil {
+			proc.handleFailure(ctx, p, StageProcess, value, err)
+		}
+	}
 
-		currState, err := getState(ctx)
+	if proc.wrapMain != nil {
+		cb = proc.wrapMain(cb)
+	}
+
+	edges := []goka.Edge{goka.Persist(&codec.Bytes{})}
+	if p.OutputsState() {
+		stateOutput, err := proc.defineOutput(p.StateStream())
 		if err != nil {
-			log.Error(err)
-			return
+			return nil, err
 		}
+		edges = append(edges, stateOutput)
+	}
 
-		output, err := func() (out any, err error) {
-			defer func() {
-				if r := recover(); r != nil {
-					e, isErr := r.(error)
-					if isErr {
-						err = e
-					}
-				}
-			}()
-
-			out = p.Update(currState, e)
-			return
-		}()
+	deadLetterEdges, err := proc.deadLetterEdges(p)
+	if err != nil {
+		return nil, err
+	}
+	edges = append(edges, deadLetterEdges...)
+	edges = append(edges, sharedStateEdges(p, txn)...)
+
+	group, err := proc.defineGroupGraph([]string{partitionByTopic(p.Name)}, p.ResultStream(), groupName(p.Name), txn.wrap(cb), edges...)
+	if err != nil {
+		return nil, err
+	}
+	return proc.newGokaProcessor(group, txn.options()...)
+}
+
+// processEvent handles an event read from src, updating the state of the partition of ctx and writing the outputs.
+func (proc *Processor) processEvent(ctx goka.Context, p *projections.Projection, inData event.EventData, src eventSource) error {
+	e := newEventAt(ctx, src, inData)
+
+	currState, err := getState(ctx)
+	if err != nil {
+		return err
+	}
+
+	inst, err := proc.instance(ctx)
+	if err != nil {
+		return err
+	}
+
+	var sharedState any
+	var sharedInitial bool
+	if p.IsBiState() {
+		sharedState, sharedInitial, err = proc.getSharedState(inst)
 		if err != nil {
-			log.Error(err)
-			return
+			return err
 		}
 
-		setState(ctx, p.State())
+		// handlers may change the shared state in place, so they get a copy of the value the changes are computed from
+		handlerShared, err := normalizeState(sharedState)
+		if err != nil {
+			return err
+		}
+		currState = []any{currState, handlerShared}
+	}
 
-		if output != nil {
-			outData := newOutputEvent(output)
+	var res projections.Result
+	err = catchPanic(func() {
+		res = inst.Update(currState, e)
+	})
+	if err != nil {
+		return err
+	}
 
-			data, err := json.Marshal(outData) // TODO: Remove NaN values from output
-			if err != nil {
-				log.Error(err)
-				return
-			}
+	newState := res.State
+	if p.IsBiState() {
+		states, _ := newState.([]any)
+		if len(states) != 2 {
+			return errors.New("state of projections using shared state must be a [partitionState, sharedState] pair")
+		}
 
-			ctx.Emit(goka.Stream(p.ResultStream()), "", data)
+		if err := proc.setSharedState(ctx, sharedState, sharedInitial, states[1]); err != nil {
+			return err
 		}
+		newState = states[0]
+	}
+
+	if err := setState(ctx, newState); err != nil {
+		return err
+	}
+
+	causation := causationMetadata(e)
+	emitHeaders := propagatedHeaders(src, causation)
+	headers := goka.WithCtxEmitHeaders(emitHeaders)
+
+	if err := proc.emitEvents(ctx, res.Emitted, causation, emitHeaders); err != nil {
+		return err
 	}
 
-	group, err := proc.defineGroupGraph(streams, p.ResultStream(), p.Name+"-group", cb)
+	output := res.Output
+	if output == nil {
+		return nil
+	}
+
+	data, err := proc.encodeOutput(ctx.Context(), p, output, causation)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	// results are keyed by partition, so that the results of a partition keep their order
+	key := res.Key
+	if key == "" {
+		key = ctx.Key()
+	}
+	ctx.Emit(goka.Stream(p.ResultStream()), key, data, headers)
+
+	// the state stream follows the state as transformBy() and filterBy() publish it, keyed by partition
+	if p.OutputsState() {
+		data, err := json.Marshal(withMetadata(newStateEvent(output), causation))
+		if err != nil {
+			return err
+		}
+		ctx.Emit(goka.Stream(p.StateStream()), ctx.Key(), data, headers)
 	}
-	return proc.newGokaProcessor(group)
+	return nil
+}
+
+// catchPanic turns a panic raised by f, such as a javascript exception, into an error.
+func catchPanic(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, isErr := r.(error)
+			if !isErr {
+				e = fmt.Errorf("%v", r)
+			}
+			err = e
+		}
+	}()
+
+	f()
+	return
 }
 
-func (proc *Processor) newGokaProcessor(group *goka.GroupGraph) (*goka.Processor, error) {
+func (proc *Processor) newGokaProcessor(group *goka.GroupGraph, opts ...goka.ProcessorOption) (*goka.Processor, error) {
 	return goka.NewProcessor(
 		proc.cfg.Brokers,
 		group,
-		goka.WithTopicManagerBuilder(goka.TopicManagerBuilderWithTopicManagerConfig(topicManagerConfig(proc.cfg))),
-		goka.WithStorageBuilder(proc.storageBuilder(string(group.Group()))),
+		append([]goka.ProcessorOption{
+			goka.WithTopicManagerBuilder(goka.TopicManagerBuilderWithTopicManagerConfig(topicManagerConfig(proc.cfg))),
+			goka.WithStorageBuilder(proc.storageBuilder(string(group.Group()))),
+		}, append(opts, proc.gokaOptions...)...)...,
 	)
 }
 
@@ -315,51 +728,195 @@ func (proc *Processor) storageBuilder(projectionName string) storage.Builder {
 	if proc.cfg.StoragePath == InMemoryStorage {
 		return storage.MemoryBuilder()
 	}
-	return storage.DefaultBuilder(path.Join(os.TempDir(), projectionName))
+	return storage.DefaultBuilder(storageDir(proc.cfg, projectionName))
+}
+
+// storageDir returns the directory holding the local storage of a processor group.
+func storageDir(cfg Config, groupName string) string {
+	base := cfg.StoragePath
+	if base == "" {
+		base = os.TempDir()
+	}
+	return path.Join(base, groupName)
 }
 
 const (
 	EventTypeProjectionResult = "Result"
+	EventTypeProjectionState  = "State"
 )
 
 func newOutputEvent(data any) event.EventData {
+	return newEvent(EventTypeProjectionResult, data)
+}
+
+func newStateEvent(data any) event.EventData {
+	return newEvent(EventTypeProjectionState, data)
+}
+
+func newEvent(eventType string, data any) event.EventData {
 	return event.EventData{
 		EventID:     uuid.NewString(),
 		ContentType: event.ContentTypeJson,
 		Metadata: event.Metadata{
-			event.MetadataKeyEventType: EventTypeProjectionResult,
+			event.MetadataKeyEventType: eventType,
 		},
 		Data: data,
 	}
 }
+
+// causationMetadata returns the correlation and causation ids of the events written while processing e.
+// The correlation id is inherited from e, or is the id of e if it starts a new correlation.
+func causationMetadata(e projections.Event) event.Metadata {
+	if e.EventId == "" {
+		return nil
+	}
+
+	correlationId := e.MetadataRaw[MetadataKeyCorrelationId]
+	if correlationId == "" {
+		correlationId = e.EventId
+	}
+
+	return event.Metadata{
+		MetadataKeyCorrelationId: correlationId,
+		MetadataKeyCausationId:   e.EventId,
+	}
+}
+
+// propagatedHeaders returns the headers of the records written while processing the event read from src.
+func propagatedHeaders(src eventSource, causation event.Metadata) goka.Headers {
+	headers := make(goka.Headers, len(src.recordHeaders)+len(causation))
+	for k, v := range src.recordHeaders {
+		headers[k] = v
+	}
+
+	for k, v := range causation {
+		headers[k] = []byte(v)
+	}
+	return headers
+}
+
+// withMetadata adds metadata to data, without overriding its own.
+func withMetadata(data event.EventData, metadata event.Metadata) event.EventData {
+	for k, v := range metadata {
+		if _, has := data.Metadata[k]; !has {
+			data.Metadata[k] = v
+		}
+	}
+	return data
+}
+
+func groupName(name string) string {
+	return name + "-group"
+}
+
+func partitionByGroupName(name string) string {
+	return name + "-partition-by-group"
+}
+
+const partitionByTopicSuffix = "-partition-by-output"
+
 func partitionByTopic(name string) string {
-	return name + "-partition-by-output"
+	return name + partitionByTopicSuffix
+}
+
+const emittedStreamsTopicSuffix = "-emitted-streams"
+
+// emittedStreamsTopic returns the compacted topic recording the streams written by the emit() and linkTo() calls of a projection.
+func emittedStreamsTopic(name string) string {
+	return name + emittedStreamsTopicSuffix
 }
 
-func (proc *Processor) buildPartitionProcessor(p *projections.Projection) (*goka.Processor, error) {
+// buildPartitionProcessor builds the processor of a partition stage.
+// If buffer is not nil, events are forwarded through it rather than being emitted right away.
+func (proc *Processor) buildPartitionProcessor(p *projections.Projection, group string, streams []string, buffer *reorderBuffer) (*goka.Processor, error) {
 	outputTopic := partitionByTopic(p.Name)
+	txn := proc.newTxnProducer(group)
 
 	cb := func(ctx goka.Context, msg any) {
-		rawMessage := msg.([]byte)
+		value, _ := msg.([]byte)
 
-		var inData event.EventData
-		if err := json.Unmarshal(rawMessage, &inData); err != nil {
-			panic(err)
+		// failed records are written to the dead-letter stream as they were read
+		rawMessage, inData, src, err := proc.readEvent(ctx, p, value)
+		if err != nil {
+			proc.handleFailure(ctx, p, StagePartition, value, err)
+			return
+		}
+
+		partition, err := proc.partitionOf(ctx, p, src, inData)
+		if err != nil {
+			proc.handleFailure(ctx, p, StagePartition, value, err)
+			return
 		}
 
-		e := NewEventFrom(ctx, inData)
-		partition := p.GetPartition(e)
-		ctx.Emit(goka.Stream(outputTopic), partition, rawMessage)
+		headers := src.headers()
+		if buffer != nil {
+			buffer.add(ctx, partition, rawMessage, headers)
+			return
+		}
+		ctx.Emit(goka.Stream(outputTopic), partition, rawMessage, goka.WithCtxEmitHeaders(headers))
+	}
+
+	edges, err := proc.deadLetterEdges(p)
+	if err != nil {
+		return nil, err
 	}
 
-	group, err := proc.defineGroupGraph(p.InputStreams, outputTopic, p.Name+"-partition-by-group", cb)
+	graph, err := proc.defineGroupGraph(streams, outputTopic, group, txn.wrap(cb), edges...)
 	if err != nil {
 		return nil, err
 	}
-	return proc.newGokaProcessor(group)
+	return proc.newGokaProcessor(graph, append(txn.options(), goka.WithNilHandling(goka.NilProcess))...)
+}
+
+// partitionOf returns the partition of an event read from src, as told by the partitionBy function of the projection,
+// or projections.GlobalPartition for non-partitioned projections.
+func (proc *Processor) partitionOf(ctx goka.Context, p *projections.Projection, src eventSource, inData event.EventData) (string, error) {
+	if !p.IsPartitioned() {
+		return projections.GlobalPartition, nil
+	}
+
+	inst, err := proc.instance(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var partition string
+	err = catchPanic(func() {
+		partition = inst.GetPartition(newEventAt(ctx, src, inData))
+	})
+	return partition, err
 }
 
-func (proc *Processor) defineGroupGraph(inputStreams []string, outputStream string, groupName string, callback goka.ProcessCallback) (*goka.GroupGraph, error) {
+// readEvent reads the event of a record of an input stream, returning it along with its JSON envelope and its source.
+// Tombstones stand for deletion events, links are resolved to their target, and other records are decoded as configured for their stream.
+func (proc *Processor) readEvent(ctx goka.Context, p *projections.Projection, value []byte) ([]byte, event.EventData, eventSource, error) {
+	src := sourceOf(ctx)
+
+	// tombstones mark the deletion of a stream or partition, and are forwarded to the $deleted handler
+	if value == nil {
+		inData := newEvent(p.DeletedEventType(), nil)
+		rawMessage, err := json.Marshal(inData)
+		return rawMessage, inData, src, err
+	}
+
+	rec := inputRecord{key: ctx.Key(), headers: ctx.Headers(), value: value}
+	rawMessage, inData, err := proc.decode(ctx.Context(), p, string(ctx.Topic()), rec)
+	if err != nil {
+		return nil, event.EventData{}, src, err
+	}
+
+	if inData.Metadata.EventType() != projections.LinkEventType {
+		return rawMessage, inData, src, nil
+	}
+
+	target, err := proc.resolveLink(ctx, p, inData)
+	if err != nil {
+		return nil, event.EventData{}, src, err
+	}
+	return target.raw, target.data, target.source, nil
+}
+
+func (proc *Processor) defineGroupGraph(inputStreams []string, outputStream string, groupName string, callback goka.ProcessCallback, edges ...goka.Edge) (*goka.GroupGraph, error) {
 	inputs := make([]goka.Edge, 0, len(inputStreams))
 	for _, stream := range inputStreams {
 		if err := proc.tpm.EnsureStreamExists(stream, proc.cfg.Partitions); err != nil {
@@ -368,13 +925,18 @@ func (proc *Processor) defineGroupGraph(inputStreams []string, outputStream stri
 		inputs = append(inputs, goka.Input(goka.Stream(stream), &codec.Bytes{}, callback))
 	}
 
-	if err := proc.tpm.EnsureStreamExists(outputStream, proc.cfg.Partitions); err != nil {
+	output, err := proc.defineOutput(outputStream)
+	if err != nil {
 		return nil, err
 	}
+	edges = append(edges, output)
 
-	return goka.DefineGroup(goka.Group(groupName),
-		append(inputs,
-			goka.Output(goka.Stream(outputStream), &codec.Bytes{}),
-			goka.Persist(&codec.Bytes{}),
-		)...), nil
+	return goka.DefineGroup(goka.Group(groupName), append(inputs, edges...)...), nil
+}
+
+func (proc *Processor) defineOutput(stream string) (goka.Edge, error) {
+	if err := proc.tpm.EnsureStreamExists(stream, proc.cfg.Partitions); err != nil {
+		return nil, err
+	}
+	return goka.Output(goka.Stream(stream), &codec.Bytes{}), nil
 }
@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/lovoo/goka"
 	"github.com/lovoo/goka/codec"
 	"github.com/ostafen/hermes/internal/event"
@@ -124,6 +127,188 @@ func (s *ProcessorSuite) TestPartitionedProjection() {
 		s.NoError(err)
 	}
 	processor.WaitShutdown()
+	s.NoError(processor.Close())
+}
+
+func (s *ProcessorSuite) TestExactlyOnceAfterCrash() {
+	const (
+		numEvents = 100
+		crashAt   = 60
+	)
+
+	projection, err := projections.Compile("eos-projection", `
+		fromStream('eos-stream').
+		when({
+			$init: () => ({ count: 0 }),
+			$any: (state, e) => {
+				state.count += 1
+			}
+		}).
+		transformBy(state => ({ Total: state.count }))
+	`)
+	s.NoError(err)
+
+	conf := s.conf
+	conf.ExactlyOnce = true
+	conf.CommitInterval = 20 * time.Millisecond
+
+	crashed, err := processor.BuildProcessor(projection, conf)
+	s.NoError(err)
+	s.NoError(processor.InjectCrash(crashed, crashAt))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.NoError(crashed.Start(ctx))
+	s.NoError(crashed.WaitReady(ctx))
+
+	emitter, err := goka.NewEmitter(s.brokers, "eos-stream", new(codec.Bytes))
+	s.NoError(err)
+
+	for i := 0; i < numEvents; i++ {
+		data, err := json.Marshal(event.EventData{
+			Metadata: event.Metadata{event.MetadataKeyEventType: "my-type"},
+		})
+		s.NoError(err)
+
+		_, err = emitter.Emit("", data)
+		s.NoError(err)
+	}
+	s.NoError(emitter.Finish())
+
+	crashed.WaitShutdown()
+	s.ErrorContains(crashed.Err(), "injected crash")
+	s.NoError(crashed.Close())
+
+	restarted, err := processor.BuildProcessor(projection, conf)
+	s.NoError(err)
+	defer restarted.Close()
+
+	s.NoError(restarted.Start(ctx))
+	defer restarted.WaitShutdown()
+
+	totals := s.readCommitted(projection.ResultStream(), numEvents, 10*time.Second)
+
+	seen := make(map[int]bool)
+	for _, total := range totals {
+		s.False(seen[total], "duplicate result %d", total)
+		seen[total] = true
+	}
+	s.Len(seen, numEvents)
+
+	s.Eventually(func() bool {
+		state, err := restarted.GetState(projections.GlobalPartition)
+		if err != nil {
+			return false
+		}
+		count, _ := state.(map[string]any)["count"].(float64)
+		return count == numEvents
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func (s *ProcessorSuite) TestReset() {
+	const numEvents = 10
+
+	projection, err := projections.Compile("reset-projection", `
+		fromStream('reset-stream').
+		when({
+			$init: () => ({ count: 0 }),
+			$any: (state, e) => {
+				state.count += 1
+			}
+		})
+	`)
+	s.NoError(err)
+
+	emitter, err := goka.NewEmitter(s.brokers, "reset-stream", new(codec.Bytes))
+	s.NoError(err)
+
+	for i := 0; i < numEvents; i++ {
+		data, err := json.Marshal(event.EventData{
+			Metadata: event.Metadata{event.MetadataKeyEventType: "my-type"},
+		})
+		s.NoError(err)
+
+		// the records are keyed, but the state of a non-partitioned projection is global
+		_, err = emitter.Emit(strconv.Itoa(i%3), data)
+		s.NoError(err)
+	}
+	s.NoError(emitter.Finish())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the state is recomputed from the first event after the reset, instead of being restored from the group table
+	for run := 0; run < 2; run++ {
+		proc, err := processor.BuildProcessor(projection, s.conf)
+		s.NoError(err)
+
+		procCtx, stop := context.WithCancel(ctx)
+		s.NoError(proc.Start(procCtx))
+
+		s.Eventually(func() bool {
+			return s.countOf(proc) == numEvents
+		}, 10*time.Second, 100*time.Millisecond)
+
+		// let the processor commit its offsets, so that a count above numEvents would show up
+		time.Sleep(time.Second)
+		s.Equal(numEvents, s.countOf(proc))
+
+		stop()
+		proc.WaitShutdown()
+		s.NoError(proc.Close())
+
+		s.NoError(processor.Reset(projection, s.conf))
+	}
+}
+
+func (s *ProcessorSuite) countOf(proc *processor.Processor) int {
+	state, err := proc.GetState(projections.GlobalPartition)
+	if err != nil {
+		return 0
+	}
+	count, _ := state.(map[string]any)["count"].(float64)
+	return int(count)
+}
+
+// readCommitted reads the totals written to a result stream by committed transactions,
+// until n totals are read and no more arrive for a while, or the timeout expires.
+func (s *ProcessorSuite) readCommitted(stream string, n int, timeout time.Duration) []int {
+	conf := sarama.NewConfig()
+	conf.Consumer.IsolationLevel = sarama.ReadCommitted
+	conf.Version = sarama.V2_4_0_0
+
+	consumer, err := sarama.NewConsumer(s.brokers, conf)
+	s.NoError(err)
+	defer consumer.Close()
+
+	pc, err := consumer.ConsumePartition(stream, 0, sarama.OffsetOldest)
+	s.NoError(err)
+	defer pc.Close()
+
+	deadline := time.After(timeout)
+
+	var totals []int
+	for {
+		idle := time.After(time.Second)
+		if len(totals) < n {
+			idle = nil
+		}
+
+		select {
+		case msg := <-pc.Messages():
+			payload := &struct {
+				Total int
+			}{}
+			s.NoError(json.Unmarshal(msg.Value, &event.EventData{Data: payload}))
+
+			totals = append(totals, payload.Total)
+		case <-idle:
+			return totals
+		case <-deadline:
+			return totals
+		}
+	}
 }
 
 func shuffledSlice(n int) []int {
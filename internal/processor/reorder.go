@@ -0,0 +1,144 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lovoo/goka"
+	"github.com/lovoo/goka/codec"
+)
+
+const reorderReleaseInterval = 10 * time.Millisecond
+
+// reorderBuffer holds the events read by a partition stage for the processing lag of the projection,
+// then releases them in timestamp order across input streams. Events of the same topic partition keep their order.
+//
+// Since a goka context cannot be used once its callback returns, released events are written through an emitter,
+// and the commit of their input record is deferred until they are written.
+type reorderBuffer struct {
+	lag     time.Duration
+	emitter reorderEmitter
+
+	mtx    sync.Mutex
+	queues map[string][]*bufferedEvent
+}
+
+// reorderEmitter writes the released events, as goka.Emitter does.
+type reorderEmitter interface {
+	EmitWithHeaders(key string, msg any, headers goka.Headers) (*goka.Promise, error)
+	Finish() error
+}
+
+type bufferedEvent struct {
+	key       string
+	value     []byte
+	headers   goka.Headers
+	timestamp time.Time
+	received  time.Time
+	commit    func(error)
+}
+
+func newReorderBuffer(cfg Config, topic string, lag time.Duration) (*reorderBuffer, error) {
+	emitter, err := goka.NewEmitter(cfg.Brokers, goka.Stream(topic), &codec.Bytes{},
+		goka.WithEmitterTopicManagerBuilder(goka.TopicManagerBuilderWithTopicManagerConfig(topicManagerConfig(cfg))),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reorderBuffer{
+		lag:     lag,
+		emitter: emitter,
+		queues:  make(map[string][]*bufferedEvent),
+	}, nil
+}
+
+func (b *reorderBuffer) add(ctx goka.Context, key string, value []byte, headers goka.Headers) {
+	e := &bufferedEvent{
+		key:       key,
+		value:     value,
+		headers:   headers,
+		timestamp: ctx.Timestamp(),
+		received:  time.Now(),
+		commit:    ctx.DeferCommit(),
+	}
+
+	b.push(fmt.Sprintf("%s/%d", ctx.Topic(), ctx.Partition()), e)
+}
+
+// push appends an event to the queue of its topic partition.
+func (b *reorderBuffer) push(queue string, e *bufferedEvent) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.queues[queue] = append(b.queues[queue], e)
+}
+
+// release writes the buffered events which waited for the processing lag, in timestamp order.
+// If all is true, every buffered event is released.
+func (b *reorderBuffer) release(now time.Time, all bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for {
+		var (
+			next string
+			head *bufferedEvent
+		)
+
+		for queue, events := range b.queues {
+			e := events[0]
+			if head == nil || e.timestamp.Before(head.timestamp) || (e.timestamp.Equal(head.timestamp) && queue < next) {
+				next, head = queue, e
+			}
+		}
+
+		// events are only released once no earlier event can still be buffered by another queue
+		if head == nil || (!all && now.Sub(head.received) < b.lag) {
+			return
+		}
+
+		if len(b.queues[next]) == 1 {
+			delete(b.queues, next)
+		} else {
+			b.queues[next] = b.queues[next][1:]
+		}
+		b.emit(head)
+	}
+}
+
+func (b *reorderBuffer) emit(e *bufferedEvent) {
+	promise, err := b.emitter.EmitWithHeaders(e.key, e.value, e.headers)
+	if err != nil {
+		e.commit(err)
+		return
+	}
+	promise.Then(e.commit)
+}
+
+// run periodically releases the buffered events, until the stage processor is done.
+// Once ctx is canceled, or while the partitions of the processor are revoked, all the buffered events are released,
+// since goka waits for pending commits before stopping its partitions.
+func (b *reorderBuffer) run(ctx context.Context, done <-chan struct{}, state goka.StateReader) {
+	defer b.emitter.Finish()
+
+	ticker := time.NewTicker(reorderReleaseInterval)
+	defer ticker.Stop()
+
+	stopping := ctx.Done()
+	all := false
+	for {
+		select {
+		case <-done:
+			b.release(time.Now(), true)
+			return
+		case <-stopping:
+			stopping = nil
+			all = true
+		case now := <-ticker.C:
+			b.release(now, all || state.IsState(goka.ProcStateStopping))
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lovoo/goka"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingEmitter records the keys of the emitted events.
+type recordingEmitter struct {
+	mtx  sync.Mutex
+	keys []string
+	err  error
+}
+
+func (e *recordingEmitter) EmitWithHeaders(key string, msg any, headers goka.Headers) (*goka.Promise, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	e.mtx.Lock()
+	e.keys = append(e.keys, key)
+	e.mtx.Unlock()
+
+	promise, finish := goka.NewPromiseWithFinisher()
+	finish(nil, nil)
+	return promise, nil
+}
+
+func (e *recordingEmitter) Finish() error {
+	return nil
+}
+
+func (e *recordingEmitter) emitted() []string {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	return append([]string(nil), e.keys...)
+}
+
+// commits records the results of the commits of the buffered events.
+type commits struct {
+	mtx  sync.Mutex
+	errs []error
+}
+
+func (c *commits) commit(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.errs = append(c.errs, err)
+}
+
+var reorderStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestBuffer(lag time.Duration) (*reorderBuffer, *recordingEmitter, *commits) {
+	emitter := &recordingEmitter{}
+	return &reorderBuffer{
+		lag:     lag,
+		emitter: emitter,
+		queues:  make(map[string][]*bufferedEvent),
+	}, emitter, &commits{}
+}
+
+// pushAt buffers an event with the given key and timestamp, as received at the given time.
+func pushAt(b *reorderBuffer, c *commits, queue, key string, timestamp, received time.Duration) {
+	b.push(queue, &bufferedEvent{
+		key:       key,
+		timestamp: reorderStart.Add(timestamp),
+		received:  reorderStart.Add(received),
+		commit:    c.commit,
+	})
+}
+
+func TestReorderBuffer(t *testing.T) {
+	t.Run("out of order arrival", func(t *testing.T) {
+		b, emitter, c := newTestBuffer(time.Second)
+
+		pushAt(b, c, "a/0", "a3", 3*time.Millisecond, 0)
+		pushAt(b, c, "b/0", "b1", time.Millisecond, 0)
+		pushAt(b, c, "a/0", "a4", 4*time.Millisecond, 0)
+		pushAt(b, c, "b/0", "b2", 2*time.Millisecond, 0)
+
+		b.release(reorderStart.Add(time.Second), false)
+		require.Equal(t, []string{"b1", "b2", "a3", "a4"}, emitter.emitted())
+		require.Equal(t, []error{nil, nil, nil, nil}, c.errs)
+		require.Empty(t, b.queues)
+	})
+
+	t.Run("order of a partition", func(t *testing.T) {
+		b, emitter, c := newTestBuffer(time.Second)
+
+		pushAt(b, c, "a/0", "a5", 5*time.Millisecond, 0)
+		pushAt(b, c, "a/0", "a1", time.Millisecond, 0)
+		pushAt(b, c, "b/0", "b3", 3*time.Millisecond, 0)
+
+		b.release(reorderStart.Add(time.Second), false)
+		require.Equal(t, []string{"b3", "a5", "a1"}, emitter.emitted())
+	})
+
+	t.Run("equal timestamps", func(t *testing.T) {
+		b, emitter, c := newTestBuffer(time.Second)
+
+		pushAt(b, c, "b/0", "b1", time.Millisecond, 0)
+		pushAt(b, c, "a/0", "a1", time.Millisecond, 0)
+
+		b.release(reorderStart.Add(time.Second), false)
+		require.Equal(t, []string{"a1", "b1"}, emitter.emitted())
+	})
+
+	t.Run("events within the lag", func(t *testing.T) {
+		b, emitter, c := newTestBuffer(time.Second)
+
+		pushAt(b, c, "a/0", "a1", time.Millisecond, 0)
+		pushAt(b, c, "a/0", "a2", 2*time.Millisecond, 500*time.Millisecond)
+
+		b.release(reorderStart.Add(999*time.Millisecond), false)
+		require.Empty(t, emitter.emitted())
+
+		b.release(reorderStart.Add(time.Second), false)
+		require.Equal(t, []string{"a1"}, emitter.emitted())
+
+		b.release(reorderStart.Add(1500*time.Millisecond), false)
+		require.Equal(t, []string{"a1", "a2"}, emitter.emitted())
+	})
+
+	t.Run("gap filled by a late event", func(t *testing.T) {
+		b, emitter, c := newTestBuffer(time.Second)
+
+		pushAt(b, c, "a/0", "a5", 5*time.Millisecond, 0)
+
+		// an earlier event of another partition arrives before a5 is released, and holds it back for its own lag
+		pushAt(b, c, "b/0", "b1", time.Millisecond, 500*time.Millisecond)
+
+		b.release(reorderStart.Add(time.Second), false)
+		require.Empty(t, emitter.emitted())
+
+		b.release(reorderStart.Add(1500*time.Millisecond), false)
+		require.Equal(t, []string{"b1", "a5"}, emitter.emitted())
+	})
+
+	t.Run("release all", func(t *testing.T) {
+		b, emitter, c := newTestBuffer(time.Hour)
+
+		pushAt(b, c, "a/0", "a2", 2*time.Millisecond, 0)
+		pushAt(b, c, "b/0", "b1", time.Millisecond, 0)
+
+		b.release(reorderStart, true)
+		require.Equal(t, []string{"b1", "a2"}, emitter.emitted())
+		require.Empty(t, b.queues)
+	})
+
+	t.Run("emit error", func(t *testing.T) {
+		b, emitter, c := newTestBuffer(time.Second)
+		emitter.err = errors.New("emit failed")
+
+		pushAt(b, c, "a/0", "a1", time.Millisecond, 0)
+
+		b.release(reorderStart.Add(time.Second), false)
+		require.Equal(t, []error{emitter.err}, c.errs)
+	})
+}
+
+func TestReorderBufferRun(t *testing.T) {
+	t.Run("flush on revoke", func(t *testing.T) {
+		b, emitter, c := newTestBuffer(time.Hour)
+
+		now := time.Now()
+		b.push("a/0", &bufferedEvent{key: "a1", timestamp: now, received: now, commit: c.commit})
+
+		state := goka.NewSignal(goka.ProcStateRunning, goka.ProcStateStopping).SetState(goka.ProcStateRunning)
+		done := make(chan struct{})
+
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			b.run(context.Background(), done, state)
+		}()
+
+		time.Sleep(5 * reorderReleaseInterval)
+		require.Empty(t, emitter.emitted())
+
+		state.SetState(goka.ProcStateStopping)
+		require.Eventually(t, func() bool {
+			return len(emitter.emitted()) == 1
+		}, time.Second, reorderReleaseInterval)
+
+		close(done)
+		<-stopped
+	})
+
+	t.Run("flush on cancel", func(t *testing.T) {
+		b, emitter, c := newTestBuffer(time.Hour)
+
+		now := time.Now()
+		b.push("a/0", &bufferedEvent{key: "a1", timestamp: now, received: now, commit: c.commit})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		state := goka.NewSignal(goka.ProcStateRunning).SetState(goka.ProcStateRunning)
+		done := make(chan struct{})
+
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			b.run(ctx, done, state)
+		}()
+
+		cancel()
+		require.Eventually(t, func() bool {
+			return len(emitter.emitted()) == 1
+		}, time.Second, reorderReleaseInterval)
+
+		close(done)
+		<-stopped
+	})
+
+	t.Run("flush when done", func(t *testing.T) {
+		b, emitter, c := newTestBuffer(time.Hour)
+
+		now := time.Now()
+		b.push("a/0", &bufferedEvent{key: "a1", timestamp: now, received: now, commit: c.commit})
+
+		done := make(chan struct{})
+		close(done)
+
+		b.run(context.Background(), done, goka.NewSignal(goka.ProcStateRunning).SetState(goka.ProcStateRunning))
+		require.Equal(t, []string{"a1"}, emitter.emitted())
+	})
+}
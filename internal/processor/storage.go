@@ -0,0 +1,39 @@
+package processor
+
+import (
+	"fmt"
+	"os"
+)
+
+// CheckStorage ensures that the configured storage path is a writable directory
+// with at least cfg.MinFreeSpace bytes available.
+func CheckStorage(cfg Config) error {
+	if cfg.StoragePath == InMemoryStorage {
+		return nil
+	}
+
+	dir := storageDir(cfg, "")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("unable to create storage directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(dir, ".hermes-check-*")
+	if err != nil {
+		return fmt.Errorf("storage directory %s is not writable: %w", dir, err)
+	}
+	f.Close()
+
+	if err := os.Remove(f.Name()); err != nil {
+		return err
+	}
+
+	free, ok, err := freeSpace(dir)
+	if err != nil {
+		return err
+	}
+
+	if ok && free < cfg.MinFreeSpace {
+		return fmt.Errorf("storage directory %s has %d bytes available, at least %d are required", dir, free, cfg.MinFreeSpace)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package processor
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageDir(t *testing.T) {
+	require.Equal(t, "/var/lib/hermes/orders-group", storageDir(Config{StoragePath: "/var/lib/hermes"}, groupName("orders")))
+	require.Equal(t, filepath.Join(os.TempDir(), "orders-group"), storageDir(Config{}, groupName("orders")))
+}
+
+func TestCheckStorage(t *testing.T) {
+	t.Run("writable directory", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "state")
+		require.NoError(t, CheckStorage(Config{StoragePath: dir}))
+
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	})
+
+	t.Run("in memory", func(t *testing.T) {
+		require.NoError(t, CheckStorage(Config{StoragePath: InMemoryStorage, MinFreeSpace: math.MaxUint64}))
+	})
+
+	t.Run("not a directory", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "file")
+		require.NoError(t, os.WriteFile(file, nil, 0o644))
+
+		require.Error(t, CheckStorage(Config{StoragePath: file}))
+	})
+
+	t.Run("not enough free space", func(t *testing.T) {
+		if _, ok, _ := freeSpace(t.TempDir()); !ok {
+			t.Skip("free space is not available on this platform")
+		}
+		require.ErrorContains(t, CheckStorage(Config{StoragePath: t.TempDir(), MinFreeSpace: math.MaxUint64}), "at least")
+	})
+}
+
+func TestRemoveLocalStorage(t *testing.T) {
+	cfg := Config{StoragePath: t.TempDir()}
+
+	for _, group := range []string{groupName("orders"), groupName("orders") + "-view", groupName("customers")} {
+		require.NoError(t, os.MkdirAll(filepath.Join(storageDir(cfg, group), "data"), 0o755))
+	}
+
+	require.NoError(t, removeLocalStorage("orders", cfg))
+
+	entries, err := os.ReadDir(cfg.StoragePath)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, groupName("customers"), entries[0].Name())
+}
@@ -0,0 +1,284 @@
+package processor
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/lovoo/goka"
+	"github.com/ostafen/hermes/internal/projections"
+	log "github.com/sirupsen/logrus"
+)
+
+// partitionStage is a partition processor, reading a set of copartitioned input streams.
+type partitionStage struct {
+	streams   []string
+	processor *goka.Processor
+	cancel    func()
+	done      chan struct{}
+}
+
+func (s *partitionStage) stop() {
+	s.cancel()
+	<-s.done
+}
+
+var internalStreamSuffixes = []string{
+	partitionByTopicSuffix,
+	emittedStreamsTopicSuffix,
+	"-table",
+	"-loop",
+}
+
+// isInternalStream reports whether a stream is owned by Kafka or Hermes, and thus must not be selected by dynamic selectors.
+// The outputs of the other projections are told by cfg.ExcludeStream, since only the ones of existing projections are excluded.
+func isInternalStream(cfg Config, p *projections.Projection, stream string) bool {
+	if strings.HasPrefix(stream, "_") {
+		return true
+	}
+
+	for _, suffix := range internalStreamSuffixes {
+		if strings.HasSuffix(stream, suffix) {
+			return true
+		}
+	}
+
+	switch stream {
+	case p.ResultStream(), p.StateStream(), p.DeadLetterStream():
+		return true
+	}
+
+	for _, s := range cfg.InternalStreams {
+		if s == stream {
+			return true
+		}
+	}
+	return cfg.ExcludeStream != nil && cfg.ExcludeStream(stream)
+}
+
+// resolveStages returns the input streams of every partition stage of a projection, keyed by consumer group.
+// Streams selected by a dynamic selector are grouped by partition count, since goka requires the inputs of a group to be copartitioned.
+func resolveStages(client sarama.Client, cfg Config, p *projections.Projection) (map[string][]string, error) {
+	if !p.IsDynamic() {
+		return map[string][]string{
+			partitionByGroupName(p.Name): p.InputStreams,
+		}, nil
+	}
+
+	if err := client.RefreshMetadata(); err != nil {
+		return nil, err
+	}
+
+	topics, err := client.Topics()
+	if err != nil {
+		return nil, err
+	}
+
+	stages := make(map[string][]string)
+	for _, topic := range topics {
+		if isInternalStream(cfg, p, topic) {
+			continue
+		}
+
+		matches, err := p.MatchesStream(topic)
+		if err != nil {
+			return nil, err
+		}
+
+		if !matches {
+			continue
+		}
+
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			return nil, err
+		}
+
+		group := partitionByGroupName(p.Name) + "-" + strconv.Itoa(len(partitions))
+		stages[group] = append(stages[group], topic)
+	}
+
+	for _, streams := range stages {
+		sort.Strings(streams)
+	}
+	return stages, nil
+}
+
+func stageStreams(stages map[string][]string) []string {
+	streams := make([]string, 0)
+	for _, s := range stages {
+		streams = append(streams, s...)
+	}
+	sort.Strings(streams)
+	return streams
+}
+
+func (p *Processor) startStages(ctx context.Context) error {
+	stages, err := resolveStages(p.client, p.cfg, p.projection)
+	if err != nil {
+		return err
+	}
+
+	if err := p.syncStages(ctx, stages, false); err != nil {
+		return err
+	}
+
+	if p.projection.IsDynamic() {
+		p.wg.Add(1)
+		go p.discoverStreams(ctx)
+	}
+	return nil
+}
+
+// discoverStreams periodically rescans the streams of a projection using a dynamic selector,
+// restarting the partition stages whose input streams changed.
+func (p *Processor) discoverStreams(ctx context.Context) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.cfg.DiscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stages, err := resolveStages(p.client, p.cfg, p.projection)
+		if err != nil {
+			log.WithField("projection", p.projection.Name).Warn(err)
+			continue
+		}
+
+		if err := p.syncStages(ctx, stages, true); err != nil {
+			p.setErr(err)
+			p.cancel()
+			return
+		}
+	}
+}
+
+// syncStages starts a partition stage for each group, restarting the ones whose input streams changed.
+// If rewind is true, newly discovered streams are consumed from the earliest offset.
+func (p *Processor) syncStages(ctx context.Context, stages map[string][]string, rewind bool) error {
+	p.stagesMtx.Lock()
+	defer p.stagesMtx.Unlock()
+
+	known := make(map[string]bool)
+	for group, stage := range p.stages {
+		for _, stream := range stage.streams {
+			known[stream] = true
+		}
+
+		if streams, has := stages[group]; !has || !equalStreams(streams, stage.streams) {
+			stage.stop()
+			delete(p.stages, group)
+		}
+	}
+
+	for group, streams := range stages {
+		if _, running := p.stages[group]; running || len(streams) == 0 {
+			continue
+		}
+
+		if rewind {
+			discovered := make([]string, 0)
+			for _, stream := range streams {
+				if !known[stream] {
+					discovered = append(discovered, stream)
+				}
+			}
+
+			if err := commitEarliestOffsets(p.client, group, discovered...); err != nil {
+				return err
+			}
+		}
+
+		stage, err := p.startStage(ctx, group, streams)
+		if err != nil {
+			return err
+		}
+		p.stages[group] = stage
+	}
+
+	p.mtx.Lock()
+	p.inputStreams = stageStreams(stages)
+	p.mtx.Unlock()
+
+	return nil
+}
+
+func (p *Processor) startStage(ctx context.Context, group string, streams []string) (*partitionStage, error) {
+	var buffer *reorderBuffer
+	if p.projection.ReordersEvents() {
+		b, err := newReorderBuffer(p.cfg, partitionByTopic(p.projection.Name), p.projection.ProcessingLag())
+		if err != nil {
+			return nil, err
+		}
+		buffer = b
+	}
+
+	proc, err := p.buildPartitionProcessor(p.projection, group, streams, buffer)
+	if err != nil {
+		if buffer != nil {
+			buffer.emitter.Finish()
+		}
+		return nil, err
+	}
+
+	stageCtx, cancel := context.WithCancel(ctx)
+	stage := &partitionStage{
+		streams:   streams,
+		processor: proc,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(stage.done)
+
+		if err := proc.Run(stageCtx); err != nil {
+			p.setErr(err)
+			p.cancel()
+		}
+	}()
+
+	if buffer != nil {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+
+			buffer.run(stageCtx, stage.done, proc.StateReader())
+		}()
+	}
+
+	err = proc.WaitForReadyContext(stageCtx)
+	if err == nil {
+		err = p.Err()
+	}
+
+	if err != nil {
+		stage.stop()
+		return nil, err
+	}
+	return stage, nil
+}
+
+func equalStreams(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,52 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ostafen/hermes/internal/projections"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsInternalStream(t *testing.T) {
+	p, err := projections.Compile("orders", `options({ resultStreamName: "order-totals", deadLetterStreamName: "order-failures" });
+		fromAll().when({}).outputState()`)
+	require.NoError(t, err)
+
+	cfg := Config{
+		InternalStreams: []string{"hermes-projections"},
+		ExcludeStream: func(stream string) bool {
+			return strings.HasPrefix(stream, "tmp-")
+		},
+	}
+
+	tests := []struct {
+		stream   string
+		internal bool
+	}{
+		{stream: "order-1"},
+		{stream: "order"},
+		{stream: "-order"},
+		{stream: "order-"},
+		{stream: "__consumer_offsets", internal: true},
+		{stream: "_schemas", internal: true},
+		{stream: "projections-customers-result"},
+		{stream: "projections-report"},
+		{stream: "orders" + emittedStreamsTopicSuffix, internal: true},
+		{stream: "orders" + partitionByTopicSuffix, internal: true},
+		{stream: "customers-table", internal: true},
+		{stream: "customers-loop", internal: true},
+		{stream: p.ResultStream(), internal: true},
+		{stream: p.StateStream(), internal: true},
+		{stream: p.DeadLetterStream(), internal: true},
+		{stream: "hermes-projections", internal: true},
+		{stream: "tmp-orders", internal: true},
+		{stream: "orders-tmp"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.stream, func(t *testing.T) {
+			require.Equal(t, test.internal, isInternalStream(cfg, p, test.stream))
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package projections
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// LinkEventType is the type of the events written by linkTo(), whose body is the Link to another event.
+const LinkEventType = "$>"
+
+// MetadataKeyTopicPartition is the metadata key holding the Kafka partition an event was read from.
+const MetadataKeyTopicPartition = "topicPartition"
+
+// Link points to the record of an event.
+type Link struct {
+	StreamId  string `json:"streamId"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// EmittedEvent is an event written by a handler through emit() or linkTo().
+type EmittedEvent struct {
+	StreamId string
+	Type     string
+	Body     any
+	Metadata map[string]string
+}
+
+var errEmptyStreamId = errors.New("streamId must not be empty")
+
+func (p *Projection) emit(streamId, eventType string, body any, metadata map[string]any) {
+	if streamId == "" {
+		panic(p.runtime.NewGoError(errEmptyStreamId))
+	}
+
+	e := EmittedEvent{
+		StreamId: streamId,
+		Type:     eventType,
+		Body:     body,
+	}
+
+	if len(metadata) > 0 {
+		e.Metadata = make(map[string]string, len(metadata))
+		for k, v := range metadata {
+			e.Metadata[k] = fmt.Sprint(v)
+		}
+	}
+	p.emitted = append(p.emitted, e)
+}
+
+func (p *Projection) linkTo(streamId string, e Event) {
+	if streamId == "" {
+		panic(p.runtime.NewGoError(errEmptyStreamId))
+	}
+
+	partition, err := strconv.ParseInt(e.MetadataRaw[MetadataKeyTopicPartition], 10, 32)
+	if err != nil {
+		panic(p.runtime.NewGoError(fmt.Errorf("linkTo() expects an event read by the projection: %w", err)))
+	}
+
+	p.emitted = append(p.emitted, EmittedEvent{
+		StreamId: streamId,
+		Type:     LinkEventType,
+		Body: Link{
+			StreamId:  e.StreamId,
+			Partition: int32(partition),
+			Offset:    e.SequenceNumber,
+		},
+	})
+}
@@ -7,17 +7,24 @@ import (
 type gojaFunc func(goja.FunctionCall) goja.Value
 
 func (f gojaFunc) Call(vm *goja.Runtime, values ...any) any {
+	return export(vm, f.CallValue(vm, values...))
+}
+
+// CallValue calls f, returning its result as a javascript value, so that undefined can be told apart from null.
+func (f gojaFunc) CallValue(vm *goja.Runtime, values ...any) goja.Value {
 	params := make([]goja.Value, 0, len(values))
 	for _, v := range values {
 		params = append(params, vm.ToValue(v))
 	}
 
-	out := f(goja.FunctionCall{
+	return f(goja.FunctionCall{
 		Arguments: params,
 	})
+}
 
+func export(vm *goja.Runtime, v goja.Value) any {
 	var x any
-	vm.ExportTo(out, &x)
+	vm.ExportTo(v, &x)
 
 	return x
 }
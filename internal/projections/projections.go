@@ -2,8 +2,12 @@ package projections
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/dop251/goja"
 )
@@ -11,18 +15,65 @@ import (
 type ProjectionFunc func(state any, e Event) (any, bool)
 
 const (
-	initFunc   = "$init"
-	anyHandler = "$any"
+	initFunc       = "$init"
+	initSharedFunc = "$initShared"
+	createdHandler = "$created"
+	deletedHandler = "$deleted"
+	anyHandler     = "$any"
+)
+
+// DefaultDeletedEventType is the type of the events marking the deletion of a stream or partition.
+const DefaultDeletedEventType = "$streamDeleted"
+
+// SharedStateKey is the partition holding the shared state of bi-state projections.
+const SharedStateKey = "$shared"
+
+// AnyStream is the key of the decoders and inputs options applying to the streams without a dedicated entry.
+const AnyStream = "*"
+
+// ErrorPolicy defines how events which cannot be decoded or processed are handled.
+type ErrorPolicy string
+
+const (
+	// ErrorPolicySkip logs the error and skips the event.
+	ErrorPolicySkip ErrorPolicy = "skip"
+	// ErrorPolicyDeadLetter writes the event to the dead-letter stream of the projection.
+	ErrorPolicyDeadLetter ErrorPolicy = "deadLetter"
+	// ErrorPolicyFail stops the projection.
+	ErrorPolicyFail ErrorPolicy = "fail"
 )
 
 type Options struct {
-	ResultStream  string `json:"resultStreamName"`
-	IncludeLinks  bool   `json:"$includeLinks"`
-	ReorderEvents bool   `json:"reorderEvents"`
-	ProcessingLag int    `json:"processingLag"`
+	ResultStream     string      `json:"resultStreamName"`
+	DeadLetterStream string      `json:"deadLetterStreamName"`
+	ErrorPolicy      ErrorPolicy `json:"errorPolicy"`
+	IncludeLinks     bool        `json:"$includeLinks"`
+	ReorderEvents    bool        `json:"reorderEvents"`
+	ProcessingLag    int         `json:"processingLag"`
+	DeletedEventType string      `json:"deletedEventType"`
+	// Decoders maps input streams to the name of the decoder of their records, "*" standing for any other stream.
+	Decoders      map[string]string `json:"decoders"`
+	ResultSubject string            `json:"resultSubject"`
+	// Inputs maps input streams whose records don't hold the envelope of an event to their input mapping,
+	// "*" standing for any other stream.
+	Inputs map[string]InputMapping `json:"inputs"`
+}
+
+// InputMapping tells how to build events from records which don't hold the envelope of an event:
+// the value of a record is the body of its event, and the other fields are selectors of the properties of the event.
+//
+// A selector is either the name of a header, prefixed by "header:", "$key" for the record key,
+// a JSON path into the body, such as "$.order.type", or else a constant.
+type InputMapping struct {
+	Type    string `json:"type"`
+	EventId string `json:"eventId"`
+	// ContentType is the content type of the body. If empty, bodies holding valid JSON are JSON, and the others binary.
+	ContentType string            `json:"contentType"`
+	Metadata    map[string]string `json:"metadata"`
 }
 
 type Event struct {
+	EventId         string            `json:"eventId"`
 	IsJson          bool              `json:"isJson"`
 	Data            any               `json:"data"`
 	Body            any               `json:"body"`
@@ -37,17 +88,36 @@ type Event struct {
 
 type PartitionFunc func(e Event) string
 
+// ResultKeyProperty is the property of the object returned by transformBy() holding the key of the result.
+const ResultKeyProperty = "$key"
+
+// GlobalPartition is the partition of every event of a non-partitioned projection, which keeps a single, global state.
+const GlobalPartition = ""
+
+// Projection is a compiled query. Since its javascript runtime is not safe for concurrent use,
+// every goroutine processing events must use its own instance, as returned by Fork.
 type Projection struct {
+	// mtx guards the runtime when evaluating the dynamic selector, which happens outside of event processing.
 	mtx     sync.Mutex
 	runtime *goja.Runtime
+	query   string
 
 	Name         string
 	InputStreams []string
 	Options      Options
 
-	currState   any
-	Operations  []ProjectionFunc
+	Operations []ProjectionFunc
+	// stateOps is the number of leading operations computing the state, the following ones only transform the output.
+	stateOps    int
 	partitionBy PartitionFunc
+	outputState bool
+	biState     bool
+	initShared  func() any
+	emitted     []EmittedEvent
+	resultKey   string
+
+	// streamFilter selects the input streams of projections using a dynamic selector, such as fromAll().
+	streamFilter func(stream string) (bool, error)
 }
 
 func (p *Projection) ResultStream() string {
@@ -57,9 +127,79 @@ func (p *Projection) ResultStream() string {
 	return fmt.Sprintf("projections-%s-result", p.Name)
 }
 
+func (p *Projection) DeadLetterStream() string {
+	if p.Options.DeadLetterStream != "" {
+		return p.Options.DeadLetterStream
+	}
+	return fmt.Sprintf("projections-%s-dead-letter", p.Name)
+}
+
+func (p *Projection) ErrorPolicy() ErrorPolicy {
+	if p.Options.ErrorPolicy == "" {
+		return ErrorPolicySkip
+	}
+	return p.Options.ErrorPolicy
+}
+
+// IncludesLinks reports whether the metadata of link events is exposed to handlers, through Event.LinkMetadataRaw.
+func (p *Projection) IncludesLinks() bool {
+	return p.Options.IncludeLinks
+}
+
+// DefaultProcessingLag is how long events are buffered by projections with reorderEvents, if processingLag is not set.
+const DefaultProcessingLag = 500 * time.Millisecond
+
+// ReordersEvents reports whether events are released in timestamp order across the input streams.
+func (p *Projection) ReordersEvents() bool {
+	return p.Options.ReorderEvents
+}
+
+// ProcessingLag is how long events are buffered before being released, when ReordersEvents is true.
+func (p *Projection) ProcessingLag() time.Duration {
+	if p.Options.ProcessingLag == 0 {
+		return DefaultProcessingLag
+	}
+	return time.Duration(p.Options.ProcessingLag) * time.Millisecond
+}
+
+// DeletedEventType is the type of the events handled by the $deleted handler.
+func (p *Projection) DeletedEventType() string {
+	if p.Options.DeletedEventType == "" {
+		return DefaultDeletedEventType
+	}
+	return p.Options.DeletedEventType
+}
+
+// DecoderOf returns the name of the decoder of the records of an input stream, or an empty string for the default one.
+func (p *Projection) DecoderOf(stream string) string {
+	if name, has := p.Options.Decoders[stream]; has {
+		return name
+	}
+	return p.Options.Decoders[AnyStream]
+}
+
+// InputOf returns the input mapping of the records of an input stream, if the projection defines one.
+func (p *Projection) InputOf(stream string) (InputMapping, bool) {
+	if m, has := p.Options.Inputs[stream]; has {
+		return m, true
+	}
+	m, has := p.Options.Inputs[AnyStream]
+	return m, has
+}
+
+// StateStream is the stream where the state is published after every update, if OutputsState is true.
+func (p *Projection) StateStream() string {
+	return fmt.Sprintf("projections-%s-state", p.Name)
+}
+
+func (p *Projection) OutputsState() bool {
+	return p.outputState
+}
+
 func (p *Projection) GetPartition(e Event) string {
-	p.mtx.Lock()
-	defer p.mtx.Unlock()
+	if p.partitionBy == nil {
+		return GlobalPartition
+	}
 	return p.partitionBy(e)
 }
 
@@ -71,6 +211,7 @@ type FromStreamsRes struct {
 
 type FromAllRes struct {
 	partitionBy
+	foreachStream
 	when
 	outputState
 }
@@ -79,11 +220,25 @@ type FromStreamsMatchingRes struct {
 	when
 }
 
+type FromCategoryRes struct {
+	partitionBy
+	foreachStream
+	when
+	outputState
+}
+
 type outputState struct {
 	p *Projection
 }
 
-func (o *outputState) OutputState() {
+func (o *outputState) OutputState() OutputStateRes {
+	o.p.outputState = true
+
+	return OutputStateRes{
+		transformBy: transformBy{p: o.p},
+		filterBy:    filterBy{p: o.p},
+		outputTo:    outputTo{p: o.p},
+	}
 }
 
 type OutputStateRes struct {
@@ -115,22 +270,89 @@ func (w *when) getHandler(handlers map[string]gojaFunc, eventType string) gojaFu
 	return h
 }
 
+func (w *when) initState(handlers map[string]gojaFunc, state any) any {
+	if !w.p.biState {
+		return w.callInit(handlers, initFunc, state)
+	}
+
+	// bi-state handlers receive the [partitionState, sharedState] pair
+	states, _ := state.([]any)
+	if len(states) != 2 {
+		states = make([]any, 2)
+	}
+
+	states[0] = w.callInit(handlers, initFunc, states[0])
+	states[1] = w.callInit(handlers, initSharedFunc, states[1])
+	return states
+}
+
+func (w *when) callInit(handlers map[string]gojaFunc, name string, state any) any {
+	if state != nil {
+		return state
+	}
+
+	initFunc, hasInit := handlers[name]
+	if hasInit {
+		return initFunc.Call(w.p.runtime)
+	}
+	return nil
+}
+
+// partitionState returns the state of the partition, excluding the shared state of bi-state projections.
+func (w *when) partitionState(state any) any {
+	if !w.p.biState {
+		return state
+	}
+
+	states, _ := state.([]any)
+	if len(states) == 0 {
+		return nil
+	}
+	return states[0]
+}
+
+// callHandler calls h, returning the new state.
+// As in EventStoreDB, a returned value replaces the state, otherwise the state mutated by the handler is kept.
+func (w *when) callHandler(h gojaFunc, state any, e Event) any {
+	if h == nil {
+		return state
+	}
+
+	// the state is read back from its javascript value, since growing an array does not update the original slice
+	stateValue := w.p.runtime.ToValue(state)
+
+	out := h.CallValue(w.p.runtime, stateValue, e)
+	if out == nil || goja.IsUndefined(out) {
+		out = stateValue
+	}
+	return export(w.p.runtime, out)
+}
+
 func (w *when) When(handlers map[string]gojaFunc) WhenRes {
+	_, w.p.biState = handlers[initSharedFunc]
+	w.p.initShared = func() any {
+		return w.callInit(handlers, initSharedFunc, nil)
+	}
+
 	w.p.Operations = append(w.p.Operations, func(state any, e Event) (any, bool) {
-		if state == nil {
-			initFunc, hasInit := handlers[initFunc]
-			if hasInit {
-				state = initFunc.Call(w.p.runtime)
+		// the state of non-partitioned projections is global, so it is never created for a partition
+		created := w.p.IsPartitioned() && w.partitionState(state) == nil
+		deleted := e.Type == w.p.DeletedEventType()
+
+		state = w.initState(handlers, state)
+
+		if deleted {
+			state = w.callHandler(handlers[deletedHandler], state, e)
+		} else {
+			if created {
+				state = w.callHandler(handlers[createdHandler], state, e)
 			}
+			state = w.callHandler(w.getHandler(handlers, e.Type), state, e)
 		}
 
-		handlerFunc := w.getHandler(handlers, e.Type)
-		if handlerFunc != nil {
-			handlerFunc.Call(w.p.runtime, state, e)
-		}
-		w.p.currState = state
 		return state, true
 	})
+	w.p.stateOps = len(w.p.Operations)
 
 	return WhenRes{
 		transformBy: transformBy{p: w.p},
@@ -179,7 +401,7 @@ type TransformByRes struct {
 func (t *transformBy) TransformBy(transformFunc gojaFunc) TransformByRes {
 	t.p.Operations = append(t.p.Operations, func(state any, e Event) (any, bool) {
 		out := transformFunc.Call(t.p.runtime, state)
-		return out, true
+		return t.p.takeResultKey(out), true
 	})
 
 	return TransformByRes{
@@ -190,6 +412,28 @@ func (t *transformBy) TransformBy(transformFunc gojaFunc) TransformByRes {
 	}
 }
 
+// takeResultKey removes the ResultKeyProperty from the output of a transformation, keeping it as the key of the result.
+func (p *Projection) takeResultKey(out any) any {
+	m, isMap := out.(map[string]any)
+	if !isMap {
+		return out
+	}
+
+	key, hasKey := m[ResultKeyProperty]
+	if !hasKey {
+		return out
+	}
+	p.resultKey = fmt.Sprint(key)
+
+	res := make(map[string]any, len(m)-1)
+	for k, v := range m {
+		if k != ResultKeyProperty {
+			res[k] = v
+		}
+	}
+	return res
+}
+
 type outputTo struct {
 	p *Projection
 }
@@ -223,35 +467,84 @@ func (p *partitionBy) PartitionBy(partitionFunc gojaFunc) PartitionByRes {
 	}
 }
 
+type foreachStream struct {
+	p *Projection
+}
+
+// ForeachStream partitions the projection by the stream of each event.
+func (f *foreachStream) ForeachStream() PartitionByRes {
+	f.p.partitionBy = func(e Event) string {
+		return e.StreamId
+	}
+
+	return PartitionByRes{
+		when: when{p: f.p},
+	}
+}
+
 func (p *Projection) IsPartitioned() bool {
 	return p.partitionBy != nil
 }
 
-func (p *Projection) updateFunc(state any, e Event) (any, bool) {
-	var currState = state
-	for _, op := range p.Operations {
-		state, forward := op(currState, e)
+// IsBiState reports whether the projection keeps a state shared across partitions, besides the state of each partition.
+// The state of bi-state projections is the [partitionState, sharedState] pair.
+func (p *Projection) IsBiState() bool {
+	return p.biState
+}
+
+// InitSharedState returns the initial shared state of a bi-state projection, as returned by $initShared.
+func (p *Projection) InitSharedState() any {
+	if p.initShared == nil {
+		return nil
+	}
+	return p.initShared()
+}
+
+// Result is the outcome of processing an event.
+type Result struct {
+	// State is the new state of the partition.
+	State any
+	// Output is the state as transformed by transformBy() and filterBy(), or nil if the event was filtered out.
+	Output any
+	// Emitted are the events written by emit() and linkTo().
+	Emitted []EmittedEvent
+	// Key is the key of the result, as returned by transformBy() in the ResultKeyProperty. It is empty if none was given.
+	Key string
+}
+
+func (p *Projection) updateFunc(state any, e Event) (newState any, output any) {
+	newState = state
+
+	currState := state
+	for i, op := range p.Operations {
+		out, forward := op(currState, e)
+		if i < p.stateOps {
+			newState = out
+		}
+
 		if !forward {
-			return state, false
+			return newState, nil
 		}
-		currState = state
+		currState = out
 	}
-	return currState, true
+	return newState, currState
 }
 
-func (p *Projection) State() any {
-	return p.currState
-}
+func (p *Projection) Update(state any, e Event) Result {
+	p.emitted = nil
+	p.resultKey = ""
 
-func (p *Projection) Update(state any, e Event) any {
-	p.mtx.Lock()
-	defer p.mtx.Unlock()
+	newState, output := p.updateFunc(state, e)
 
-	newState, forward := p.updateFunc(state, e)
-	if forward {
-		return newState
+	res := Result{
+		State:   newState,
+		Output:  output,
+		Emitted: p.emitted,
 	}
-	return nil
+	if output != nil {
+		res.Key = p.resultKey
+	}
+	return res
 }
 
 func (p *Projection) options(opts Options) {
@@ -262,6 +555,115 @@ func (p *Projection) fromStream(stream string) FromStreamsRes {
 	return p.fromStreams(stream)
 }
 
+func (p *Projection) fromAll() FromAllRes {
+	p.streamFilter = func(stream string) (bool, error) {
+		return true, nil
+	}
+
+	return FromAllRes{
+		when:          when{p: p},
+		partitionBy:   partitionBy{p: p},
+		foreachStream: foreachStream{p: p},
+		outputState:   outputState{p: p},
+	}
+}
+
+// CategorySeparator separates the category of a stream from its id, as in "order-123".
+const CategorySeparator = "-"
+
+// Category returns the category of a stream, that is the part of its name before the first separator.
+// A stream without separator has no category.
+func Category(stream string) string {
+	category, _, found := strings.Cut(stream, CategorySeparator)
+	if !found {
+		return ""
+	}
+	return category
+}
+
+func (p *Projection) fromCategory(category string) FromCategoryRes {
+	p.streamFilter = func(stream string) (bool, error) {
+		return Category(stream) == category, nil
+	}
+
+	return FromCategoryRes{
+		when:          when{p: p},
+		partitionBy:   partitionBy{p: p},
+		foreachStream: foreachStream{p: p},
+		outputState:   outputState{p: p},
+	}
+}
+
+// IsDynamic reports whether the input streams of the projection are selected at runtime,
+// rather than being listed in the query.
+func (p *Projection) IsDynamic() bool {
+	return p.streamFilter != nil
+}
+
+// MatchesStream reports whether a stream is selected by the dynamic selector of the projection.
+func (p *Projection) MatchesStream(stream string) (bool, error) {
+	if p.streamFilter == nil {
+		return false, nil
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.streamFilter(stream)
+}
+
+// fromStreamsMatching selects the streams matching either a predicate,
+// a regular expression or a string pattern.
+func (p *Projection) fromStreamsMatching(matcher goja.Value) FromStreamsMatchingRes {
+	filter, err := p.streamMatcher(matcher)
+	if err != nil {
+		panic(p.runtime.NewGoError(err))
+	}
+
+	p.streamFilter = filter
+
+	return FromStreamsMatchingRes{
+		when: when{p: p},
+	}
+}
+
+func (p *Projection) streamMatcher(matcher goja.Value) (func(stream string) (bool, error), error) {
+	if predicate, isFunc := goja.AssertFunction(matcher); isFunc {
+		return func(stream string) (bool, error) {
+			res, err := predicate(goja.Undefined(), p.runtime.ToValue(stream))
+			if err != nil {
+				return false, err
+			}
+			return res.ToBoolean(), nil
+		}, nil
+	}
+
+	if obj, isObj := matcher.(*goja.Object); isObj && obj.ClassName() == "RegExp" {
+		test, _ := goja.AssertFunction(obj.Get("test"))
+
+		return func(stream string) (bool, error) {
+			res, err := test(obj, p.runtime.ToValue(stream))
+			if err != nil {
+				return false, err
+			}
+			return res.ToBoolean(), nil
+		}, nil
+	}
+
+	pattern, isString := matcher.Export().(string)
+	if !isString {
+		return nil, errors.New("fromStreamsMatching() expects a function, a regular expression or a string pattern")
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(stream string) (bool, error) {
+		return re.MatchString(stream), nil
+	}, nil
+}
+
 func panicIfErr(err error) {
 	if err != nil {
 		panic(err)
@@ -296,17 +698,66 @@ func (p *Projection) setupHandlers() {
 	err = p.runtime.Set("fromStreams", p.fromStreams)
 	panicIfErr(err)
 
+	err = p.runtime.Set("fromAll", p.fromAll)
+	panicIfErr(err)
+
+	err = p.runtime.Set("fromStreamsMatching", p.fromStreamsMatching)
+	panicIfErr(err)
+
+	err = p.runtime.Set("fromCategory", p.fromCategory)
+	panicIfErr(err)
+
+	err = p.runtime.Set("emit", p.emit)
+	panicIfErr(err)
+
+	err = p.runtime.Set("linkTo", p.linkTo)
+	panicIfErr(err)
+
 	err = p.runtime.Set("log", logFunc)
 	panicIfErr(err)
 }
 
+var (
+	ErrNoInputStreams            = errors.New("projection does not select any stream")
+	ErrSharedStateNotPartitioned = errors.New("$initShared requires a partitioned projection")
+)
+
 func Compile(name, query string) (*Projection, error) {
 	p := &Projection{
 		Name:    name,
 		runtime: goja.New(),
+		query:   query,
 	}
 	p.setup()
 
-	_, err := p.runtime.RunString(query)
-	return p, err
+	if _, err := p.runtime.RunString(query); err != nil {
+		return p, err
+	}
+	return p, p.validate()
+}
+
+// Fork compiles a new instance of the projection, with its own javascript runtime.
+func (p *Projection) Fork() (*Projection, error) {
+	return Compile(p.Name, p.query)
+}
+
+func (p *Projection) validate() error {
+	if len(p.InputStreams) == 0 && !p.IsDynamic() {
+		return ErrNoInputStreams
+	}
+
+	if p.IsBiState() && !p.IsPartitioned() {
+		return ErrSharedStateNotPartitioned
+	}
+
+	if p.Options.ProcessingLag < 0 {
+		return fmt.Errorf("processingLag must not be negative: %d", p.Options.ProcessingLag)
+	}
+
+	switch p.ErrorPolicy() {
+	case ErrorPolicySkip, ErrorPolicyDeadLetter, ErrorPolicyFail:
+	default:
+		return fmt.Errorf("unknown error policy: %s", p.Options.ErrorPolicy)
+	}
+	return nil
 }
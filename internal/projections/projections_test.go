@@ -0,0 +1,359 @@
+package projections_test
+
+import (
+	"testing"
+
+	"github.com/ostafen/hermes/internal/projections"
+	"github.com/stretchr/testify/require"
+)
+
+func runProjection(t *testing.T, query string, events ...projections.Event) any {
+	t.Helper()
+
+	p, err := projections.Compile("test", query)
+	require.NoError(t, err)
+
+	var state any
+	for _, e := range events {
+		state = p.Update(state, e).State
+	}
+	return state
+}
+
+func newEvent(eventType string, body map[string]any) projections.Event {
+	return projections.Event{
+		IsJson: true,
+		Type:   eventType,
+		Body:   body,
+		Data:   body,
+	}
+}
+
+func TestHandlerReturnValue(t *testing.T) {
+	events := []projections.Event{
+		newEvent("Added", map[string]any{"amount": 2}),
+		newEvent("Added", map[string]any{"amount": 3}),
+	}
+
+	tests := []struct {
+		name     string
+		query    string
+		expected any
+	}{
+		{
+			name: "mutated object",
+			query: `fromStream("s").when({
+				$init: () => ({ total: 0 }),
+				Added: (s, e) => { s.total += e.body.amount }
+			})`,
+			expected: map[string]any{"total": int64(5)},
+		},
+		{
+			name: "returned object",
+			query: `fromStream("s").when({
+				$init: () => ({ total: 0 }),
+				Added: (s, e) => ({ total: s.total + e.body.amount, last: e.body.amount })
+			})`,
+			expected: map[string]any{"total": int64(5), "last": int64(3)},
+		},
+		{
+			name: "mutated array",
+			query: `fromStream("s").when({
+				$init: () => [],
+				Added: (s, e) => { s.push(e.body.amount) }
+			})`,
+			expected: []any{int64(2), int64(3)},
+		},
+		{
+			name: "returned array",
+			query: `fromStream("s").when({
+				$init: () => [],
+				Added: (s, e) => s.concat([e.body.amount])
+			})`,
+			expected: []any{int64(2), int64(3)},
+		},
+		{
+			name: "primitive",
+			query: `fromStream("s").when({
+				$init: () => 0,
+				Added: (s, e) => s + e.body.amount
+			})`,
+			expected: int64(5),
+		},
+		{
+			name: "primitive without init",
+			query: `fromStream("s").when({
+				$any: (s, e) => (s || 0) + e.body.amount
+			})`,
+			expected: int64(5),
+		},
+		{
+			name: "returned null",
+			query: `fromStream("s").when({
+				$init: () => ({ total: 0 }),
+				Added: (s, e) => null
+			})`,
+			expected: nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			require.Equal(t, test.expected, runProjection(t, test.query, events...))
+		})
+	}
+}
+
+func TestCreatedAndDeletedHandlers(t *testing.T) {
+	handlers := `{
+		$init: () => ({ created: 0, deleted: 0, events: 0 }),
+		$created: (s, e) => { s.created++ },
+		$deleted: (s, e) => { s.deleted++ },
+		$any: (s, e) => { s.events++ }
+	}`
+
+	events := []projections.Event{
+		newEvent("Added", nil),
+		newEvent("Added", nil),
+		newEvent(projections.DefaultDeletedEventType, nil),
+	}
+
+	state := runProjection(t, `fromStream("s").partitionBy(e => e.streamId).when(`+handlers+`)`, events...)
+	require.Equal(t, map[string]any{"created": int64(1), "deleted": int64(1), "events": int64(2)}, state)
+
+	// the state of non-partitioned projections is global, and never created for a partition
+	state = runProjection(t, `fromStream("s").when(`+handlers+`)`, events...)
+	require.Equal(t, map[string]any{"created": int64(0), "deleted": int64(1), "events": int64(2)}, state)
+}
+
+func TestDeletedEventTypeOption(t *testing.T) {
+	query := `options({ deletedEventType: "Removed" })
+	fromStream("s").when({
+		$init: () => ({ deleted: false }),
+		$deleted: (s, e) => ({ deleted: true })
+	})`
+
+	state := runProjection(t, query, newEvent("Removed", nil))
+	require.Equal(t, map[string]any{"deleted": true}, state)
+}
+
+func TestInitShared(t *testing.T) {
+	query := `fromStream("s").partitionBy(e => e.body.id).when({
+		$init: () => 0,
+		$initShared: () => ({ total: 0 }),
+		Added: (s, e) => { s[0]++; s[1].total += e.body.amount }
+	})`
+
+	state := runProjection(t, query,
+		newEvent("Added", map[string]any{"id": "a", "amount": 2}),
+		newEvent("Added", map[string]any{"id": "a", "amount": 3}),
+	)
+	require.Equal(t, []any{int64(2), map[string]any{"total": int64(5)}}, state)
+}
+
+func TestEmitAndLinkTo(t *testing.T) {
+	p, err := projections.Compile("test", `fromStream("orders").when({
+		OrderPlaced: (s, e) => {
+			emit("customer-" + e.body.customer, "CustomerOrdered", { order: e.body.id }, { source: "orders" })
+			linkTo("customer-orders", e)
+		}
+	})`)
+	require.NoError(t, err)
+
+	e := newEvent("OrderPlaced", map[string]any{"customer": "c1", "id": "o1"})
+	e.StreamId = "orders"
+	e.SequenceNumber = 42
+	e.MetadataRaw = map[string]string{projections.MetadataKeyTopicPartition: "3"}
+
+	res := p.Update(nil, e)
+	require.Equal(t, []projections.EmittedEvent{
+		{
+			StreamId: "customer-c1",
+			Type:     "CustomerOrdered",
+			Body:     map[string]any{"order": "o1"},
+			Metadata: map[string]string{"source": "orders"},
+		},
+		{
+			StreamId: "customer-orders",
+			Type:     projections.LinkEventType,
+			Body:     projections.Link{StreamId: "orders", Partition: 3, Offset: 42},
+		},
+	}, res.Emitted)
+
+	res = p.Update(nil, newEvent("OrderShipped", nil))
+	require.Empty(t, res.Emitted)
+}
+
+func TestUpdateOutput(t *testing.T) {
+	p, err := projections.Compile("test", `fromStream("s").when({
+		$init: () => ({ count: 0 }),
+		$any: (s, e) => { s.count++ }
+	}).filterBy(s => s.count % 2 == 0).transformBy(s => ({ half: s.count / 2 }))`)
+	require.NoError(t, err)
+
+	res := p.Update(nil, newEvent("Added", nil))
+	require.Equal(t, map[string]any{"count": int64(1)}, res.State)
+	require.Nil(t, res.Output)
+
+	res = p.Update(res.State, newEvent("Added", nil))
+	require.Equal(t, map[string]any{"count": int64(2)}, res.State)
+	require.Equal(t, map[string]any{"half": int64(1)}, res.Output)
+}
+
+func TestTransformByResultKey(t *testing.T) {
+	p, err := projections.Compile("test", `fromStream("s").when({
+		$init: () => ({ count: 0 }),
+		$any: (s, e) => { s.count++; s.customer = e.body.customer }
+	}).transformBy(s => ({ $key: s.customer, count: s.count }))`)
+	require.NoError(t, err)
+
+	res := p.Update(nil, newEvent("Added", map[string]any{"customer": "c1"}))
+	require.Equal(t, "c1", res.Key)
+	require.Equal(t, map[string]any{"count": int64(1)}, res.Output)
+	require.Equal(t, map[string]any{"count": int64(1), "customer": "c1"}, res.State)
+
+	p, err = projections.Compile("test", `fromStream("s").when({
+		$any: (s, e) => ({ customer: e.body.customer })
+	})`)
+	require.NoError(t, err)
+
+	res = p.Update(nil, newEvent("Added", map[string]any{"customer": "c1"}))
+	require.Empty(t, res.Key)
+}
+
+func TestFork(t *testing.T) {
+	p, err := projections.Compile("test", `options({ resultStreamName: "out" })
+	fromStream("s").partitionBy(e => e.body.id).when({
+		$any: (s, e) => (s || 0) + 1
+	})`)
+	require.NoError(t, err)
+
+	inst, err := p.Fork()
+	require.NoError(t, err)
+	require.Equal(t, p.Options, inst.Options)
+	require.Equal(t, p.InputStreams, inst.InputStreams)
+
+	e := newEvent("Added", map[string]any{"id": "a"})
+	require.Equal(t, "a", inst.GetPartition(e))
+	require.Equal(t, int64(1), inst.Update(nil, e).State)
+}
+
+func TestCategory(t *testing.T) {
+	tests := []struct {
+		stream   string
+		expected string
+	}{
+		{stream: "order-123", expected: "order"},
+		{stream: "order-item-1", expected: "order"},
+		{stream: "order", expected: ""},
+		{stream: "-123", expected: ""},
+		{stream: "order-", expected: "order"},
+		{stream: "$ce-order", expected: "$ce"},
+		{stream: "", expected: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.stream, func(t *testing.T) {
+			require.Equal(t, test.expected, projections.Category(test.stream))
+		})
+	}
+}
+
+func TestMatchesStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		matches []string
+		misses  []string
+		dynamic bool
+	}{
+		{
+			name:    "fromStream",
+			query:   `fromStream("order-1")`,
+			misses:  []string{"order-1", "order-2"},
+			dynamic: false,
+		},
+		{
+			name:    "fromAll",
+			query:   `fromAll()`,
+			matches: []string{"order-1", "order", "$stats", "-"},
+			dynamic: true,
+		},
+		{
+			name:    "fromCategory",
+			query:   `fromCategory("order")`,
+			matches: []string{"order-1", "order-item-1", "order-"},
+			misses:  []string{"order", "orders-1", "-order", "$ce-order", "customer-order-1"},
+			dynamic: true,
+		},
+		{
+			name:    "fromCategory with a $ prefix",
+			query:   `fromCategory("$ce")`,
+			matches: []string{"$ce-order"},
+			misses:  []string{"ce-order", "$ce"},
+			dynamic: true,
+		},
+		{
+			name:    "fromStreamsMatching a string pattern",
+			query:   `fromStreamsMatching("^order-[0-9]+$")`,
+			matches: []string{"order-1", "order-42"},
+			misses:  []string{"order-", "order-a", "xorder-1", "$order-1"},
+			dynamic: true,
+		},
+		{
+			name:    "fromStreamsMatching a regular expression",
+			query:   `fromStreamsMatching(/^\$/)`,
+			matches: []string{"$stats", "$ce-order"},
+			misses:  []string{"stats", "order-$"},
+			dynamic: true,
+		},
+		{
+			name:    "fromStreamsMatching a predicate",
+			query:   `fromStreamsMatching(s => s.endsWith("-archive"))`,
+			matches: []string{"order-archive", "-archive"},
+			misses:  []string{"archive", "order-archived"},
+			dynamic: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := projections.Compile("test", test.query)
+			require.NoError(t, err)
+			require.Equal(t, test.dynamic, p.IsDynamic())
+
+			for _, stream := range test.matches {
+				matches, err := p.MatchesStream(stream)
+				require.NoError(t, err)
+				require.True(t, matches, stream)
+			}
+
+			for _, stream := range test.misses {
+				matches, err := p.MatchesStream(stream)
+				require.NoError(t, err)
+				require.False(t, matches, stream)
+			}
+		})
+	}
+}
+
+func TestFromStreamsMatchingInvalidPattern(t *testing.T) {
+	_, err := projections.Compile("test", `fromStreamsMatching("order-[")`)
+	require.Error(t, err)
+
+	_, err = projections.Compile("test", `fromStreamsMatching(42)`)
+	require.Error(t, err)
+}
+
+func TestForeachStream(t *testing.T) {
+	p, err := projections.Compile("test", `fromCategory("order").foreachStream().when({
+		$init: () => 0,
+		Added: (s, e) => s + 1
+	})`)
+	require.NoError(t, err)
+	require.True(t, p.IsPartitioned())
+
+	for _, stream := range []string{"order-1", "order-2", ""} {
+		require.Equal(t, stream, p.GetPartition(projections.Event{StreamId: stream}))
+	}
+}
@@ -0,0 +1,368 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/hamba/avro/v2"
+)
+
+// avroCodec decodes and encodes Avro payloads. Logical types are handled as their underlying type.
+type avroCodec struct {
+	schema avro.Schema
+}
+
+func newAvroCodec(schema *Schema, refs []importedSchema) (codec, error) {
+	// each codec has its own cache, so that schemas of different subjects can define types with the same name
+	cache := &avro.SchemaCache{}
+
+	// referenced schemas define the named types the schema uses
+	for _, ref := range refs {
+		if _, err := avro.ParseWithCache(ref.Text, "", cache); err != nil {
+			return nil, fmt.Errorf("invalid reference %s: %w", ref.name, err)
+		}
+	}
+
+	s, err := avro.ParseWithCache(schema.Text, "", cache)
+	if err != nil {
+		return nil, err
+	}
+	return &avroCodec{schema: s}, nil
+}
+
+func (c *avroCodec) decode(payload []byte) (string, any, error) {
+	d := &avroDecoder{
+		r:     avro.NewReader(nil, 0).Reset(payload),
+		items: int64(len(payload)),
+	}
+
+	value := d.read(c.schema)
+	if d.r.Error != nil {
+		return "", nil, d.r.Error
+	}
+
+	var name string
+	if named, isNamed := c.schema.(avro.NamedSchema); isNamed {
+		name = named.FullName()
+	}
+	return name, value, nil
+}
+
+func (c *avroCodec) encode(value any) ([]byte, error) {
+	v, err := avroValue(c.schema, value)
+	if err != nil {
+		return nil, err
+	}
+	return avro.Marshal(c.schema, v)
+}
+
+// avroDecoder decodes payloads into the types produced by encoding/json, except for integers, bytes and fixed values.
+// Unions are decoded as the value of their branch.
+//
+// The generic decoding of hamba/avro keeps reading the items of an array or a map after an error,
+// so a corrupt block count makes it loop and allocate for as many items. The decoder rather stops at the first error,
+// and rejects block counts exceeding the number of items the payload can hold, each taking at least a byte.
+type avroDecoder struct {
+	r     *avro.Reader
+	items int64
+}
+
+func (d *avroDecoder) blockCount() int64 {
+	n, _ := d.r.ReadBlockHeader()
+	if d.r.Error != nil {
+		return 0
+	}
+
+	if n < 0 || n > d.items {
+		d.r.ReportError("ReadBlockHeader", fmt.Sprintf("invalid block count %d", n))
+		return 0
+	}
+	d.items -= n
+	return n
+}
+
+func (d *avroDecoder) read(s avro.Schema) any {
+	if d.r.Error != nil {
+		return nil
+	}
+
+	switch s.Type() {
+	case avro.Null:
+		return nil
+	case avro.Boolean:
+		return d.r.ReadBool()
+	case avro.Int:
+		return d.r.ReadInt()
+	case avro.Long:
+		return d.r.ReadLong()
+	case avro.Float:
+		return d.r.ReadFloat()
+	case avro.Double:
+		return d.r.ReadDouble()
+	case avro.Bytes:
+		return d.r.ReadBytes()
+	case avro.String:
+		return d.r.ReadString()
+	case avro.Fixed:
+		b := make([]byte, s.(*avro.FixedSchema).Size())
+		d.r.Read(b)
+		return b
+	case avro.Enum:
+		symbols := s.(*avro.EnumSchema).Symbols()
+
+		idx := d.r.ReadInt()
+		if idx < 0 || int(idx) >= len(symbols) {
+			d.r.ReportError("Read", fmt.Sprintf("invalid symbol %d", idx))
+			return nil
+		}
+		return symbols[idx]
+	case avro.Union:
+		branches := s.(*avro.UnionSchema).Types()
+
+		idx := d.r.ReadLong()
+		if idx < 0 || idx >= int64(len(branches)) {
+			d.r.ReportError("Read", fmt.Sprintf("invalid union branch %d", idx))
+			return nil
+		}
+		return d.read(branches[idx])
+	case avro.Ref:
+		return d.read(s.(*avro.RefSchema).Schema())
+	case avro.Record:
+		fields := s.(*avro.RecordSchema).Fields()
+
+		record := make(map[string]any, len(fields))
+		for _, f := range fields {
+			record[f.Name()] = d.read(f.Type())
+		}
+		return record
+	case avro.Array:
+		itemSchema := s.(*avro.ArraySchema).Items()
+
+		items := []any{}
+		for n := d.blockCount(); n > 0; n = d.blockCount() {
+			for i := int64(0); i < n && d.r.Error == nil; i++ {
+				items = append(items, d.read(itemSchema))
+			}
+		}
+		return items
+	case avro.Map:
+		valueSchema := s.(*avro.MapSchema).Values()
+
+		values := map[string]any{}
+		for n := d.blockCount(); n > 0; n = d.blockCount() {
+			for i := int64(0); i < n && d.r.Error == nil; i++ {
+				key := d.r.ReadString()
+				values[key] = d.read(valueSchema)
+			}
+		}
+		return values
+	}
+
+	d.r.ReportError("Read", fmt.Sprintf("unsupported type %s", s.Type()))
+	return nil
+}
+
+var errAvroType = errors.New("value does not match the schema")
+
+// avroValue converts a value made of the types produced by encoding/json into the types hamba/avro encodes with s:
+// numbers are converted to the type of the schema, and the values of unions are keyed by the name of the first branch they match.
+func avroValue(s avro.Schema, value any) (any, error) {
+	switch s.Type() {
+	case avro.Null:
+		if value != nil {
+			return nil, fmt.Errorf("%w: expected null, got %T", errAvroType, value)
+		}
+		return nil, nil
+	case avro.Boolean:
+		if _, isBool := value.(bool); !isBool {
+			return nil, fmt.Errorf("%w: expected boolean, got %T", errAvroType, value)
+		}
+		return value, nil
+	case avro.Int:
+		v, isInt := toInt64(value)
+		if !isInt || v != int64(int32(v)) {
+			return nil, fmt.Errorf("%w: expected int, got %v", errAvroType, value)
+		}
+		return int32(v), nil
+	case avro.Long:
+		v, isInt := toInt64(value)
+		if !isInt {
+			return nil, fmt.Errorf("%w: expected long, got %v", errAvroType, value)
+		}
+		return v, nil
+	case avro.Float:
+		v, isNumber := toFloat64(value)
+		if !isNumber {
+			return nil, fmt.Errorf("%w: expected float, got %T", errAvroType, value)
+		}
+		return float32(v), nil
+	case avro.Double:
+		v, isNumber := toFloat64(value)
+		if !isNumber {
+			return nil, fmt.Errorf("%w: expected double, got %T", errAvroType, value)
+		}
+		return v, nil
+	case avro.Bytes:
+		b, isBytes := toBytes(value)
+		if !isBytes {
+			return nil, fmt.Errorf("%w: expected bytes, got %T", errAvroType, value)
+		}
+		return b, nil
+	case avro.String:
+		if _, isString := value.(string); !isString {
+			return nil, fmt.Errorf("%w: expected string, got %T", errAvroType, value)
+		}
+		return value, nil
+	case avro.Fixed:
+		size := s.(*avro.FixedSchema).Size()
+
+		b, isBytes := toBytes(value)
+		if !isBytes || len(b) != size {
+			return nil, fmt.Errorf("%w: expected %d bytes", errAvroType, size)
+		}
+
+		// fixed values are encoded from byte arrays of their size
+		fixed := reflect.New(reflect.ArrayOf(size, reflect.TypeOf(byte(0)))).Elem()
+		reflect.Copy(fixed, reflect.ValueOf(b))
+		return fixed.Interface(), nil
+	case avro.Enum:
+		symbol, _ := value.(string)
+		for _, sym := range s.(*avro.EnumSchema).Symbols() {
+			if sym == symbol {
+				return symbol, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: %v is not a symbol of the enum", errAvroType, value)
+	case avro.Union:
+		for _, branch := range s.(*avro.UnionSchema).Types() {
+			if v, err := avroValue(branch, value); err == nil {
+				return map[string]any{unionBranchName(branch): v}, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: %T matches no branch of the union", errAvroType, value)
+	case avro.Ref:
+		return avroValue(s.(*avro.RefSchema).Schema(), value)
+	case avro.Record:
+		rs := s.(*avro.RecordSchema)
+
+		record, isMap := value.(map[string]any)
+		if !isMap {
+			return nil, fmt.Errorf("%w: expected record %s, got %T", errAvroType, rs.FullName(), value)
+		}
+
+		// missing fields are left out, so that their default value is used
+		res := make(map[string]any, len(rs.Fields()))
+		for _, f := range rs.Fields() {
+			v, has := record[f.Name()]
+			if !has {
+				continue
+			}
+
+			converted, err := avroValue(f.Type(), v)
+			if err != nil {
+				return nil, fmt.Errorf("field %s.%s: %w", rs.FullName(), f.Name(), err)
+			}
+			res[f.Name()] = converted
+		}
+		return res, nil
+	case avro.Array:
+		items, isSlice := value.([]any)
+		if !isSlice {
+			return nil, fmt.Errorf("%w: expected array, got %T", errAvroType, value)
+		}
+
+		res := make([]any, len(items))
+		for i, item := range items {
+			v, err := avroValue(s.(*avro.ArraySchema).Items(), item)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = v
+		}
+		return res, nil
+	case avro.Map:
+		values, isMap := value.(map[string]any)
+		if !isMap {
+			return nil, fmt.Errorf("%w: expected map, got %T", errAvroType, value)
+		}
+
+		res := make(map[string]any, len(values))
+		for k, item := range values {
+			v, err := avroValue(s.(*avro.MapSchema).Values(), item)
+			if err != nil {
+				return nil, err
+			}
+			res[k] = v
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unsupported type %s", s.Type())
+}
+
+// unionBranchName returns the name hamba/avro selects a branch of a union with: the full name of named types, or the type otherwise.
+func unionBranchName(s avro.Schema) string {
+	if ref, isRef := s.(*avro.RefSchema); isRef {
+		s = ref.Schema()
+	}
+
+	if named, isNamed := s.(avro.NamedSchema); isNamed {
+		return named.FullName()
+	}
+
+	name := string(s.Type())
+	if logical, isLogical := s.(avro.LogicalTypeSchema); isLogical && logical.Logical() != nil {
+		name += "." + string(logical.Logical().Type())
+	}
+	return name
+}
+
+func toInt64(value any) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		if v == math.Trunc(v) && !math.IsInf(v, 0) {
+			return int64(v), true
+		}
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	}
+	return 0, false
+}
+
+func toFloat64(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func toBytes(value any) ([]byte, bool) {
+	switch v := value.(type) {
+	case string:
+		return []byte(v), true
+	case []byte:
+		return v, true
+	}
+	return nil, false
+}
@@ -0,0 +1,95 @@
+package registry
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// magicByte starts the records written in the Confluent wire format, followed by the 4 bytes id of their schema.
+const magicByte = 0
+
+var ErrNotWireFormat = errors.New("record is not in the schema registry wire format")
+
+// codec decodes and encodes the payloads following the schema id in the wire format.
+type codec interface {
+	// decode returns the decoded payload, along with the full name of its type, if the schema defines one.
+	decode(payload []byte) (name string, value any, err error)
+	encode(value any) ([]byte, error)
+}
+
+func newCodec(schema *Schema, refs []importedSchema) (codec, error) {
+	switch schema.Type {
+	case SchemaTypeAvro:
+		return newAvroCodec(schema, refs)
+	case SchemaTypeProtobuf:
+		return newProtobufCodec(schema, refs)
+	case SchemaTypeJson:
+		return jsonCodec{}, nil
+	}
+	return nil, fmt.Errorf("unsupported schema type %q", schema.Type)
+}
+
+// Record is a record decoded through its schema.
+type Record struct {
+	Schema *Schema
+	// Name is the full name of the type of the record, such as an Avro record or a protobuf message, if any.
+	Name  string
+	Value any
+}
+
+// IsWireFormat reports whether data may be a record in the Confluent wire format.
+func IsWireFormat(data []byte) bool {
+	return len(data) >= 5 && data[0] == magicByte
+}
+
+// Decode decodes a record in the Confluent wire format, fetching its schema from the registry.
+// Values are made of the types produced by encoding/json, except for integers, bytes and fixed values.
+func (c *Client) Decode(ctx context.Context, data []byte) (*Record, error) {
+	if !IsWireFormat(data) {
+		return nil, ErrNotWireFormat
+	}
+
+	s, err := c.compiledByID(ctx, int(binary.BigEndian.Uint32(data[1:5])))
+	if err != nil {
+		return nil, err
+	}
+
+	name, value, err := s.codec.decode(data[5:])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding record with schema %d: %w", s.ID, err)
+	}
+	return &Record{Schema: s.Schema, Name: name, Value: value}, nil
+}
+
+// Encode encodes value in the Confluent wire format, using the latest schema of the subject.
+func (c *Client) Encode(ctx context.Context, subject string, value any) ([]byte, error) {
+	s, err := c.compiledLatest(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := s.codec.encode(value)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding record with schema %d: %w", s.ID, err)
+	}
+
+	data := make([]byte, 5, 5+len(payload))
+	data[0] = magicByte
+	binary.BigEndian.PutUint32(data[1:5], uint32(s.ID))
+	return append(data, payload...), nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) decode(payload []byte) (string, any, error) {
+	var value any
+	err := json.Unmarshal(payload, &value)
+	return "", value, err
+}
+
+func (jsonCodec) encode(value any) ([]byte, error) {
+	return json.Marshal(value)
+}
@@ -0,0 +1,128 @@
+package registry
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/bufbuild/protocompile"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protobufCodec decodes protobuf messages into their JSON mapping, using the original field names.
+//
+// In the wire format, the payload starts with the indexes of its message type within the schema:
+// the index of a top level message, followed by the indexes of nested messages, if any.
+type protobufCodec struct {
+	file protoreflect.FileDescriptor
+}
+
+func newProtobufCodec(schema *Schema, refs []importedSchema) (codec, error) {
+	name := fmt.Sprintf("schema-%d.proto", schema.ID)
+
+	// referenced schemas are imported by their name, and well known types are available as well
+	sources := map[string]string{name: schema.Text}
+	for _, ref := range refs {
+		sources[ref.name] = ref.Text
+	}
+
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(sources),
+		}),
+	}
+
+	files, err := compiler.Compile(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	fd := files[0]
+	if fd.Messages().Len() == 0 {
+		return nil, fmt.Errorf("schema defines no message")
+	}
+	return &protobufCodec{file: fd}, nil
+}
+
+func (c *protobufCodec) decode(payload []byte) (string, any, error) {
+	md, n, err := c.messageType(payload)
+	if err != nil {
+		return "", nil, err
+	}
+
+	msg := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(payload[n:], msg); err != nil {
+		return "", nil, err
+	}
+
+	data, err := protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}.Marshal(msg)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return "", nil, err
+	}
+	return string(md.FullName()), value, nil
+}
+
+// messageType reads the message indexes at the start of payload, returning the message type and the size of the indexes.
+func (c *protobufCodec) messageType(payload []byte) (protoreflect.MessageDescriptor, int, error) {
+	count, n := binary.Varint(payload)
+	if n <= 0 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	// a single 0 stands for the first message
+	indexes := []int64{0}
+	if count > 0 {
+		indexes = indexes[:0]
+		for i := int64(0); i < count; i++ {
+			idx, m := binary.Varint(payload[n:])
+			if m <= 0 {
+				return nil, 0, io.ErrUnexpectedEOF
+			}
+			n += m
+			indexes = append(indexes, idx)
+		}
+	}
+
+	messages := c.file.Messages()
+
+	var md protoreflect.MessageDescriptor
+	for _, idx := range indexes {
+		if idx < 0 || idx >= int64(messages.Len()) {
+			return nil, 0, fmt.Errorf("invalid message index %d", idx)
+		}
+		md = messages.Get(int(idx))
+		messages = md.Messages()
+	}
+	return md, n, nil
+}
+
+// encode encodes value as the first message of the schema.
+func (c *protobufCodec) encode(value any) ([]byte, error) {
+	md := c.file.Messages().Get(0)
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := dynamicpb.NewMessage(md)
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+
+	payload, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(binary.AppendVarint(nil, 0), payload...), nil
+}
@@ -0,0 +1,305 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SchemaType string
+
+const (
+	SchemaTypeAvro     SchemaType = "AVRO"
+	SchemaTypeProtobuf SchemaType = "PROTOBUF"
+	SchemaTypeJson     SchemaType = "JSON"
+)
+
+// Reference is a schema imported by another one, such as a protobuf import or an Avro named type defined elsewhere.
+type Reference struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+}
+
+// Schema is a schema registered in the schema registry.
+type Schema struct {
+	ID         int         `json:"id"`
+	Subject    string      `json:"subject"`
+	Version    int         `json:"version"`
+	Type       SchemaType  `json:"schemaType"`
+	Text       string      `json:"schema"`
+	References []Reference `json:"references"`
+}
+
+// Error is an error returned by the schema registry.
+type Error struct {
+	StatusCode int    `json:"-"`
+	Code       int    `json:"error_code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("schema registry error %d: %s", e.Code, e.Message)
+}
+
+// Is reports server errors as ErrUnavailable.
+func (e *Error) Is(target error) bool {
+	return target == ErrUnavailable && e.StatusCode >= http.StatusInternalServerError
+}
+
+// ErrUnavailable is returned when the schema registry can't be reached or fails with a server error,
+// as opposed to errors caused by the request, such as an unknown schema.
+var ErrUnavailable = errors.New("schema registry is unavailable")
+
+// unavailableError is an error reaching the schema registry.
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrUnavailable, e.err)
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+const (
+	// DefaultTimeout is the timeout of the requests of clients built without an http.Client.
+	DefaultTimeout = 10 * time.Second
+
+	// requests failing with ErrUnavailable are tried requestAttempts times, waiting retryBackoff before the first retry,
+	// and twice as long before each of the next ones.
+	requestAttempts = 3
+	retryBackoff    = 200 * time.Millisecond
+)
+
+// Client reads schemas from a Confluent compatible schema registry.
+// Schemas are cached, as well as the latest version of subjects, so that a new version is only picked up by a new Client.
+// Requests failing because the registry is unavailable are retried a few times before returning ErrUnavailable.
+type Client struct {
+	url  string
+	http *http.Client
+
+	mtx    sync.Mutex
+	byId   map[int]*compiledSchema
+	latest map[string]*compiledSchema
+	byRef  map[Reference]*Schema
+}
+
+// compiledSchema is a schema along with the codec of its type.
+type compiledSchema struct {
+	*Schema
+	codec codec
+}
+
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+
+	return &Client{
+		url:    strings.TrimSuffix(baseURL, "/"),
+		http:   httpClient,
+		byId:   make(map[int]*compiledSchema),
+		latest: make(map[string]*compiledSchema),
+		byRef:  make(map[Reference]*Schema),
+	}
+}
+
+// SchemaByID returns the schema with the given id.
+func (c *Client) SchemaByID(ctx context.Context, id int) (*Schema, error) {
+	s, err := c.compiledByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.Schema, nil
+}
+
+// LatestSchema returns the latest version of the schema of a subject.
+func (c *Client) LatestSchema(ctx context.Context, subject string) (*Schema, error) {
+	s, err := c.compiledLatest(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	return s.Schema, nil
+}
+
+func (c *Client) compiledByID(ctx context.Context, id int) (*compiledSchema, error) {
+	c.mtx.Lock()
+	s := c.byId[id]
+	c.mtx.Unlock()
+
+	if s != nil {
+		return s, nil
+	}
+
+	var schema Schema
+	if err := c.get(ctx, "/schemas/ids/"+strconv.Itoa(id), &schema); err != nil {
+		return nil, err
+	}
+	schema.ID = id
+
+	return c.compile(ctx, &schema)
+}
+
+func (c *Client) compiledLatest(ctx context.Context, subject string) (*compiledSchema, error) {
+	c.mtx.Lock()
+	s := c.latest[subject]
+	c.mtx.Unlock()
+
+	if s != nil {
+		return s, nil
+	}
+
+	var schema Schema
+	if err := c.get(ctx, "/subjects/"+url.PathEscape(subject)+"/versions/latest", &schema); err != nil {
+		return nil, err
+	}
+
+	s, err := c.compile(ctx, &schema)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	c.latest[subject] = s
+	c.mtx.Unlock()
+
+	return s, nil
+}
+
+func (c *Client) compile(ctx context.Context, schema *Schema) (*compiledSchema, error) {
+	// the registry omits the type of Avro schemas
+	if schema.Type == "" {
+		schema.Type = SchemaTypeAvro
+	}
+
+	refs, err := c.references(ctx, schema, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cdc, err := newCodec(schema, refs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema %d: %w", schema.ID, err)
+	}
+
+	s := &compiledSchema{Schema: schema, codec: cdc}
+
+	c.mtx.Lock()
+	c.byId[schema.ID] = s
+	c.mtx.Unlock()
+
+	return s, nil
+}
+
+// importedSchema is a schema referenced by another one, along with the name it is imported with.
+type importedSchema struct {
+	name string
+	*Schema
+}
+
+// references returns the schemas referenced by schema, directly or not, so that each schema follows its own references.
+func (c *Client) references(ctx context.Context, schema *Schema, visited map[Reference]bool) ([]importedSchema, error) {
+	if visited == nil {
+		visited = make(map[Reference]bool)
+	}
+
+	var res []importedSchema
+	for _, ref := range schema.References {
+		if visited[ref] {
+			continue
+		}
+		visited[ref] = true
+
+		refSchema, err := c.reference(ctx, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		nested, err := c.references(ctx, refSchema, visited)
+		if err != nil {
+			return nil, err
+		}
+		res = append(append(res, nested...), importedSchema{name: ref.Name, Schema: refSchema})
+	}
+	return res, nil
+}
+
+func (c *Client) reference(ctx context.Context, ref Reference) (*Schema, error) {
+	c.mtx.Lock()
+	s := c.byRef[ref]
+	c.mtx.Unlock()
+
+	if s != nil {
+		return s, nil
+	}
+
+	var schema Schema
+	path := "/subjects/" + url.PathEscape(ref.Subject) + "/versions/" + strconv.Itoa(ref.Version)
+	if err := c.get(ctx, path, &schema); err != nil {
+		return nil, err
+	}
+
+	c.mtx.Lock()
+	c.byRef[ref] = &schema
+	c.mtx.Unlock()
+
+	return &schema, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, v any) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.tryGet(ctx, path, v)
+		if attempt == requestAttempts || !errors.Is(err, ErrUnavailable) {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) tryGet(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json, application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return &unavailableError{err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return &unavailableError{err: err}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		regErr := &Error{StatusCode: resp.StatusCode, Code: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+		_ = json.Unmarshal(body, regErr)
+		return regErr
+	}
+	return json.Unmarshal(body, v)
+}
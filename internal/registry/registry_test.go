@@ -0,0 +1,302 @@
+package registry_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ostafen/hermes/internal/registry"
+	"github.com/stretchr/testify/require"
+)
+
+const orderAvroSchema = `{
+	"type": "record",
+	"name": "OrderPlaced",
+	"namespace": "com.example",
+	"fields": [
+		{ "name": "id", "type": "long" },
+		{ "name": "customer", "type": "string" },
+		{ "name": "amount", "type": "double" },
+		{ "name": "tags", "type": { "type": "array", "items": "string" } },
+		{ "name": "status", "type": { "type": "enum", "name": "Status", "symbols": ["NEW", "PAID"] } },
+		{ "name": "note", "type": ["null", "string"], "default": null },
+		{ "name": "quantities", "type": { "type": "map", "values": "int" } }
+	]
+}`
+
+const commonProtoSchema = `
+syntax = "proto3";
+package common;
+
+message Money {
+	string currency = 1;
+	int64 units = 2;
+}
+`
+
+const orderProtoSchema = `
+syntax = "proto3";
+package orders;
+
+import "common.proto";
+
+// an order
+message Order {
+	int64 id = 1;
+	string customer = 2;
+	repeated string tags = 3;
+	Status status = 4;
+	map<string, int32> quantities = 5;
+	common.Money total = 6;
+	optional string note = 7;
+	repeated int32 codes = 8 [packed = true, json_name = "codeList"];
+
+	message Item {
+		string sku = 1;
+	}
+
+	enum Status {
+		UNKNOWN = 0;
+		NEW = 1;
+	}
+}
+
+message Refund {
+	int64 order_id = 1;
+}
+`
+
+// schemaRegistry is a stub of the schema registry, serving the given responses by path.
+func schemaRegistry(t testing.TB, responses map[string]any) *registry.Client {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, has := responses[r.URL.Path]
+		if !has {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]any{"error_code": 40403, "message": "Schema not found"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(server.Close)
+
+	return registry.NewClient(server.URL, server.Client())
+}
+
+func TestAvro(t *testing.T) {
+	client := schemaRegistry(t, map[string]any{
+		"/schemas/ids/1":                         map[string]any{"schema": `{"type":"record","name":"User","fields":[{"name":"id","type":"long"},{"name":"name","type":"string"}]}`},
+		"/subjects/orders-value/versions/latest": map[string]any{"id": 2, "subject": "orders-value", "version": 1, "schema": orderAvroSchema},
+	})
+
+	ctx := context.Background()
+
+	rec, err := client.Decode(ctx, []byte{0, 0, 0, 0, 1, 0x02, 0x04, 'a', 'b'})
+	require.NoError(t, err)
+	require.Equal(t, "User", rec.Name)
+	require.Equal(t, map[string]any{"id": int64(1), "name": "ab"}, rec.Value)
+
+	order := map[string]any{
+		"id":         float64(42),
+		"customer":   "c1",
+		"amount":     9.5,
+		"tags":       []any{"a", "b"},
+		"status":     "PAID",
+		"quantities": map[string]any{"sku-1": float64(3)},
+	}
+
+	data, err := client.Encode(ctx, "orders-value", order)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 0, 2}, data[:5])
+
+	rec, err = client.Decode(ctx, data)
+	require.NoError(t, err)
+	require.Equal(t, "com.example.OrderPlaced", rec.Name)
+	require.Equal(t, map[string]any{
+		"id":         int64(42),
+		"customer":   "c1",
+		"amount":     9.5,
+		"tags":       []any{"a", "b"},
+		"status":     "PAID",
+		"note":       nil,
+		"quantities": map[string]any{"sku-1": int32(3)},
+	}, rec.Value)
+
+	_, err = client.Encode(ctx, "orders-value", map[string]any{"id": "not a number"})
+	require.Error(t, err)
+}
+
+func TestProtobuf(t *testing.T) {
+	client := schemaRegistry(t, map[string]any{
+		"/schemas/ids/2": map[string]any{
+			"schemaType": "PROTOBUF",
+			"schema":     orderProtoSchema,
+			"references": []any{map[string]any{"name": "common.proto", "subject": "common", "version": 1}},
+		},
+		"/subjects/common/versions/1": map[string]any{"schemaType": "PROTOBUF", "schema": commonProtoSchema},
+		"/subjects/orders-value/versions/latest": map[string]any{
+			"id":         2,
+			"schemaType": "PROTOBUF",
+			"schema":     orderProtoSchema,
+			"references": []any{map[string]any{"name": "common.proto", "subject": "common", "version": 1}},
+		},
+	})
+
+	ctx := context.Background()
+
+	// the first message, with id = 1 and customer = "c"
+	rec, err := client.Decode(ctx, []byte{0, 0, 0, 0, 2, 0, 0x08, 0x01, 0x12, 0x01, 'c'})
+	require.NoError(t, err)
+	require.Equal(t, "orders.Order", rec.Name)
+
+	value := rec.Value.(map[string]any)
+	require.Equal(t, "1", value["id"])
+	require.Equal(t, "c", value["customer"])
+	require.Equal(t, "UNKNOWN", value["status"])
+
+	// message indexes [0, 1] select the Item message nested in Order, which follows the entry of the quantities map, with sku = "x"
+	rec, err = client.Decode(ctx, []byte{0, 0, 0, 0, 2, 0x04, 0, 0x02, 0x0a, 0x01, 'x'})
+	require.NoError(t, err)
+	require.Equal(t, "orders.Order.Item", rec.Name)
+	require.Equal(t, map[string]any{"sku": "x"}, rec.Value)
+
+	// message indexes [1] select the Refund message
+	rec, err = client.Decode(ctx, []byte{0, 0, 0, 0, 2, 0x02, 0x02, 0x08, 0x07})
+	require.NoError(t, err)
+	require.Equal(t, "orders.Refund", rec.Name)
+	require.Equal(t, map[string]any{"order_id": "7"}, rec.Value)
+
+	data, err := client.Encode(ctx, "orders-value", map[string]any{
+		"id":         float64(5),
+		"customer":   "c2",
+		"tags":       []any{"a"},
+		"status":     "NEW",
+		"quantities": map[string]any{"sku-1": float64(2)},
+		"total":      map[string]any{"currency": "EUR", "units": float64(10)},
+		"note":       "fragile",
+		"codes":      []any{float64(1), float64(2)},
+	})
+	require.NoError(t, err)
+
+	rec, err = client.Decode(ctx, data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{
+		"id":         "5",
+		"customer":   "c2",
+		"tags":       []any{"a"},
+		"status":     "NEW",
+		"quantities": map[string]any{"sku-1": float64(2)},
+		"total":      map[string]any{"currency": "EUR", "units": "10"},
+		"note":       "fragile",
+		"codes":      []any{float64(1), float64(2)},
+	}, rec.Value)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	client := schemaRegistry(t, nil)
+
+	_, err := client.Decode(context.Background(), []byte(`{"data":{}}`))
+	require.ErrorIs(t, err, registry.ErrNotWireFormat)
+
+	_, err = client.Decode(context.Background(), []byte{0, 0, 0, 0, 9, 0})
+
+	var regErr *registry.Error
+	require.True(t, errors.As(err, &regErr))
+	require.Equal(t, 40403, regErr.Code)
+
+	// unknown schemas are not an outage of the registry
+	require.False(t, errors.Is(err, registry.ErrUnavailable))
+}
+
+func TestUnavailable(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the registry recovers after the retries of the first record
+		if requests.Add(1) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"schema": `"string"`})
+	}))
+	defer server.Close()
+
+	client := registry.NewClient(server.URL, server.Client())
+
+	_, err := client.Decode(context.Background(), []byte{0, 0, 0, 0, 1, 0x02, 'a'})
+	require.ErrorIs(t, err, registry.ErrUnavailable)
+	require.Equal(t, int32(3), requests.Load())
+
+	rec, err := client.Decode(context.Background(), []byte{0, 0, 0, 0, 1, 0x02, 'a'})
+	require.NoError(t, err)
+	require.Equal(t, "a", rec.Value)
+
+	server.Close()
+
+	_, err = registry.NewClient(server.URL, nil).Decode(context.Background(), []byte{0, 0, 0, 0, 1, 0x02, 'a'})
+	require.ErrorIs(t, err, registry.ErrUnavailable)
+}
+
+// FuzzDecode makes sure that truncated or corrupt payloads are rejected, rather than making the decoders panic, loop or exhaust memory.
+func FuzzDecode(f *testing.F) {
+	client := schemaRegistry(f, map[string]any{
+		"/schemas/ids/1":                         map[string]any{"schema": orderAvroSchema},
+		"/subjects/orders-avro/versions/latest":  map[string]any{"id": 1, "schema": orderAvroSchema},
+		"/subjects/common/versions/1":            map[string]any{"schemaType": "PROTOBUF", "schema": commonProtoSchema},
+		"/schemas/ids/2":                         map[string]any{"schemaType": "PROTOBUF", "schema": orderProtoSchema, "references": []any{map[string]any{"name": "common.proto", "subject": "common", "version": 1}}},
+		"/subjects/orders-proto/versions/latest": map[string]any{"id": 2, "schemaType": "PROTOBUF", "schema": orderProtoSchema, "references": []any{map[string]any{"name": "common.proto", "subject": "common", "version": 1}}},
+	})
+
+	ctx := context.Background()
+
+	avroOrder, err := client.Encode(ctx, "orders-avro", map[string]any{
+		"id":         float64(42),
+		"customer":   "c1",
+		"amount":     9.5,
+		"tags":       []any{"a", "b"},
+		"status":     "PAID",
+		"note":       "fragile",
+		"quantities": map[string]any{"sku-1": float64(3)},
+	})
+	require.NoError(f, err)
+
+	protoOrder, err := client.Encode(ctx, "orders-proto", map[string]any{
+		"id":         float64(5),
+		"tags":       []any{"a"},
+		"quantities": map[string]any{"sku-1": float64(2)},
+		"total":      map[string]any{"currency": "EUR", "units": float64(10)},
+	})
+	require.NoError(f, err)
+
+	// every truncation of valid payloads
+	for _, payload := range [][]byte{avroOrder, protoOrder} {
+		for n := 5; n < len(payload); n++ {
+			f.Add(payload[:n])
+		}
+	}
+
+	avroHeader := []byte{0, 0, 0, 0, 1}
+	corrupt := [][]byte{
+		// a customer whose length overflows the size of the payload
+		binary.AppendVarint(binary.AppendVarint(append([]byte(nil), avroHeader...), 1), math.MaxInt64-8),
+		// tags made of a huge block of items
+		binary.AppendVarint(append(append([]byte(nil), avroOrder[:7]...), 0x02, 'c', 0, 0, 0, 0, 0, 0, 0x23, 0x40), 1<<62),
+		// a block whose count is the smallest negative number
+		binary.AppendVarint(append(append([]byte(nil), avroOrder[:7]...), 0x02, 'c', 0, 0, 0, 0, 0, 0, 0x23, 0x40), math.MinInt64),
+		// a huge number of message indexes
+		binary.AppendVarint([]byte{0, 0, 0, 0, 2}, math.MaxInt64),
+	}
+	for _, payload := range corrupt {
+		f.Add(payload)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = client.Decode(ctx, data)
+	})
+}
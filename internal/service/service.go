@@ -3,15 +3,36 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/ostafen/hermes/internal/processor"
 	"github.com/ostafen/hermes/internal/projections"
+	"github.com/ostafen/hermes/internal/store"
+	log "github.com/sirupsen/logrus"
 )
 
 var (
 	ErrProjectionExist    = errors.New("projection already exist")
 	ErrProjectionNotExist = errors.New("projection not exist")
+	ErrProjectionStopped  = errors.New("projection is not running")
+	ErrPartitionRequired  = errors.New("partition is required for partitioned projections")
+	ErrPartitionNotUsed   = errors.New("partition is not allowed for non-partitioned projections")
+	ErrInvalidQuery       = errors.New("invalid query")
+	ErrProjectionInvalid  = errors.New("projection query does not compile")
+	ErrProjectionBusy     = errors.New("projection is being changed by another request")
+
+	errStartCanceled = errors.New("projection was stopped while starting")
+)
+
+type Status string
+
+const (
+	StatusStarting Status = "starting"
+	StatusRunning  Status = "running"
+	StatusFaulted  Status = "faulted"
+	StatusStopped  Status = "stopped"
 )
 
 type CreateProjectionInput struct {
@@ -20,27 +41,174 @@ type CreateProjectionInput struct {
 }
 
 type DeleteProjectionInput struct {
+	Name                 string `json:"name" validate:"required"`
+	DeleteState          bool   `json:"deleteState"`
+	DeleteEmittedStreams bool   `json:"deleteEmittedStreams"`
+}
+
+type UpdateQueryInput struct {
+	Name  string `json:"name" validate:"required"`
+	Query string `json:"query" validate:"required"`
+	Reset bool   `json:"reset"`
+}
+
+type ResetProjectionInput struct {
+	Name string `json:"name" validate:"required"`
+}
+
+type EnableProjectionInput struct {
+	Name string `json:"name" validate:"required"`
+}
+
+type DisableProjectionInput struct {
 	Name string `json:"name" validate:"required"`
 }
 
+type GetProjectionInput struct {
+	Name string `json:"name" validate:"required"`
+}
+
+type GetStateInput struct {
+	Name      string  `json:"name" validate:"required"`
+	Partition *string `json:"partition"`
+}
+
+type ProjectionInfo struct {
+	Name         string   `json:"name"`
+	Query        string   `json:"query"`
+	Version      int      `json:"version"`
+	InputStreams []string `json:"inputStreams"`
+	ResultStream string   `json:"resultStream"`
+	Partitioned  bool     `json:"partitioned"`
+	Enabled      bool     `json:"enabled"`
+	Status       Status   `json:"status"`
+	LastError    string   `json:"lastError,omitempty"`
+}
+
 type ProjectionService interface {
 	Create(ctx context.Context, in CreateProjectionInput) error
 	Delete(ctx context.Context, in DeleteProjectionInput) error
+	UpdateQuery(ctx context.Context, in UpdateQueryInput) error
+	Reset(ctx context.Context, in ResetProjectionInput) error
+	Enable(ctx context.Context, in EnableProjectionInput) error
+	Disable(ctx context.Context, in DisableProjectionInput) error
+	Get(ctx context.Context, in GetProjectionInput) (ProjectionInfo, error)
+	List(ctx context.Context) ([]ProjectionInfo, error)
+	GetState(ctx context.Context, in GetStateInput) (any, error)
 	Shutdown() error
 }
 
+// projectionProcessor is the running processor of a projection.
+type projectionProcessor interface {
+	InputStreams() []string
+	GetState(partition string) (any, error)
+	Err() error
+	WaitShutdown()
+	Close() error
+}
+
+// processorFactory starts the processors of projections, and deletes or resets the state they keep in Kafka.
+type processorFactory interface {
+	Start(ctx context.Context, p *projections.Projection, cfg processor.Config) (projectionProcessor, error)
+	Reset(p *projections.Projection, cfg processor.Config) error
+	Delete(p *projections.Projection, cfg processor.Config, opts processor.DeleteOptions) error
+}
+
+// kafkaProcessors is the processorFactory of processor.Processor.
+type kafkaProcessors struct{}
+
+// Start builds the processor of a projection and waits for it to be running.
+func (kafkaProcessors) Start(ctx context.Context, p *projections.Projection, cfg processor.Config) (projectionProcessor, error) {
+	proc, err := processor.BuildProcessor(p, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := proc.Start(ctx); err != nil {
+		proc.WaitShutdown()
+		proc.Close()
+		return nil, err
+	}
+	return proc, nil
+}
+
+func (kafkaProcessors) Reset(p *projections.Projection, cfg processor.Config) error {
+	return processor.Reset(p, cfg)
+}
+
+func (kafkaProcessors) Delete(p *projections.Projection, cfg processor.Config, opts processor.DeleteOptions) error {
+	return processor.Delete(p, cfg, opts)
+}
+
 type projectionData struct {
+	def        store.Definition
 	projection *projections.Projection
-	processor  *processor.Processor
-	ctx        context.Context
+	processor  projectionProcessor
 	cancel     func()
+
+	status  Status
+	lastErr error
+
+	// generation is incremented whenever the processor is stopped, so that a start in progress can tell it was superseded.
+	generation int
+	// busy is set while a request changing the projection runs without the lock held, such as its creation:
+	// other changes are rejected meanwhile.
+	busy bool
+}
+
+func (data *projectionData) stop() {
+	data.generation++
+
+	if data.cancel == nil {
+		return
+	}
+
+	// a processor which is still starting is not assigned yet: canceling it is enough, its start discards it
+	data.cancel()
+	if data.processor != nil {
+		data.processor.WaitShutdown()
+		data.processor.Close()
+	}
+
+	data.processor = nil
+	data.cancel = nil
+	data.status = StatusStopped
+}
+
+func (data *projectionData) info() ProjectionInfo {
+	info := ProjectionInfo{
+		Name:    data.def.Name,
+		Query:   data.def.Query,
+		Version: data.def.Version,
+		Enabled: data.def.Enabled,
+		Status:  data.status,
+	}
+
+	if data.processor != nil {
+		info.InputStreams = data.processor.InputStreams()
+	} else if data.projection != nil {
+		info.InputStreams = data.projection.InputStreams
+	}
+
+	if data.projection != nil {
+		info.ResultStream = data.projection.ResultStream()
+		info.Partitioned = data.projection.IsPartitioned()
+	}
+
+	if data.lastErr != nil {
+		info.LastError = data.lastErr.Error()
+	}
+	return info
 }
 
 type projectionService struct {
 	mtx sync.Mutex
 
 	cfg         processor.Config
-	projections map[string]projectionData
+	store       store.Store
+	processors  processorFactory
+	projections map[string]*projectionData
+	outputs     *outputRegistry
 }
 
 func (s *projectionService) Create(ctx context.Context, in CreateProjectionInput) error {
@@ -51,62 +219,473 @@ func (s *projectionService) Create(ctx context.Context, in CreateProjectionInput
 		return ErrProjectionExist
 	}
 
-	proj, err := projections.Compile(in.Name, in.Query)
+	data, err := newProjectionData(store.Definition{
+		Name:    in.Name,
+		Query:   in.Query,
+		Enabled: true,
+		Version: 1,
+	})
 	if err != nil {
 		return err
 	}
 
-	proc, err := processor.BuildProcessor(proj, s.cfg)
+	// the projection is registered while starting, so that it is listed as such and its name is taken,
+	// but it cannot be changed until it is stored, so that a failed start can be rolled back
+	s.projections[in.Name] = data
+
+	data.busy = true
+	err = s.start(data)
+	data.busy = false
+
 	if err != nil {
+		delete(s.projections, in.Name)
 		return err
 	}
 
-	procCtx, cancel := context.WithCancel(context.Background())
-	if err := proc.Start(procCtx); err != nil {
-		cancel()
+	if err := s.store.Put(ctx, data.def); err != nil {
+		data.stop()
+		delete(s.projections, in.Name)
 		return err
 	}
 
-	s.projections[in.Name] = projectionData{
-		ctx:        ctx,
-		cancel:     cancel,
+	s.outputs.set(data.projection)
+	return nil
+}
+
+func newProjectionData(def store.Definition) (*projectionData, error) {
+	proj, err := projections.Compile(def.Name, def.Query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidQuery, err)
+	}
+
+	def.Options = proj.Options
+
+	return &projectionData{
+		def:        def,
 		projection: proj,
-		processor:  proc,
+		status:     StatusStopped,
+	}, nil
+}
+
+// start builds and starts the processor of a projection, marking it as starting meanwhile.
+// It must be called with the lock held, which is released while the processor recovers its state,
+// so that the service stays responsive, and held again once the processor is running or failed.
+// A projection which fails to start is reported as faulted.
+func (s *projectionService) start(data *projectionData) error {
+	procCtx, cancel := context.WithCancel(context.Background())
+
+	data.cancel = cancel
+	data.status = StatusStarting
+	data.lastErr = nil
+	generation := data.generation
+	proj := data.projection
+
+	s.mtx.Unlock()
+	proc, err := s.processors.Start(procCtx, proj, s.cfg)
+	s.mtx.Lock()
+
+	if data.generation != generation {
+		if proc != nil {
+			cancel()
+			proc.WaitShutdown()
+			proc.Close()
+		}
+		return errStartCanceled
 	}
+
+	if err != nil {
+		cancel()
+		data.cancel = nil
+		data.status = StatusFaulted
+		data.lastErr = err
+		return err
+	}
+
+	data.processor = proc
+	data.status = StatusRunning
+
+	go s.watch(data, proc, generation)
+
 	return nil
 }
 
+// unlocked runs f, such as a round-trip to Kafka, with the lock released, so that the service stays responsive.
+// The projection is marked as busy meanwhile, so that other changes to it are rejected.
+// It must be called with the lock held, which is held again once f returns.
+func (s *projectionService) unlocked(data *projectionData, f func() error) error {
+	data.busy = true
+	s.mtx.Unlock()
+
+	err := f()
+
+	s.mtx.Lock()
+	data.busy = false
+	return err
+}
+
+// lookup returns the projection a request changes.
+func (s *projectionService) lookup(name string) (*projectionData, error) {
+	data, has := s.projections[name]
+	if !has {
+		return nil, ErrProjectionNotExist
+	}
+
+	if data.busy {
+		return nil, ErrProjectionBusy
+	}
+	return data, nil
+}
+
+// watch updates the status of a projection once its processor stops, started at the given generation of the projection.
+// A processor fenced by another member of its group is started again, so that it recovers its state.
+func (s *projectionService) watch(data *projectionData, proc projectionProcessor, generation int) {
+	proc.WaitShutdown()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// a processor which was replaced is closed by whoever stopped it
+	if data.processor != proc {
+		return
+	}
+
+	proc.Close()
+	data.cancel = nil
+	data.processor = nil
+
+	err := proc.Err()
+	if errors.Is(err, processor.ErrFenced) && data.generation == generation {
+		log.WithField("projection", data.def.Name).Warn(err)
+
+		_ = s.start(data)
+		return
+	}
+
+	if err != nil {
+		log.WithField("projection", data.def.Name).Error(err)
+
+		data.status = StatusFaulted
+		data.lastErr = err
+	} else {
+		data.status = StatusStopped
+	}
+}
+
 func (p *projectionService) Delete(ctx context.Context, in DeleteProjectionInput) error {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
 
-	data, has := p.projections[in.Name]
-	if !has {
-		return ErrProjectionNotExist
+	data, err := p.lookup(in.Name)
+	if err != nil {
+		return err
 	}
 
-	data.cancel()
-	data.processor.WaitShutdown() // TODO: take ctx
+	opts := processor.DeleteOptions{
+		State:          in.DeleteState,
+		EmittedStreams: in.DeleteEmittedStreams,
+	}
+
+	// the topics to delete are told by the compiled query
+	if data.projection == nil && (opts.State || opts.EmittedStreams) {
+		return ErrProjectionInvalid
+	}
+
+	data.stop() // TODO: take ctx
+
+	if data.projection != nil {
+		if err := p.unlocked(data, func() error { return p.processors.Delete(data.projection, p.cfg, opts) }); err != nil {
+			return err
+		}
+	}
+
+	if err := p.store.Delete(ctx, in.Name); err != nil {
+		return err
+	}
 
 	delete(p.projections, in.Name)
+	p.outputs.remove(in.Name)
+
+	return nil
+}
+
+// UpdateQuery replaces the query of a projection, restarting its processor if enabled.
+// The state of the projection is preserved, unless a reset is requested.
+func (p *projectionService) UpdateQuery(ctx context.Context, in UpdateQueryInput) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	data, err := p.lookup(in.Name)
+	if err != nil {
+		return err
+	}
+
+	def := data.def
+	def.Query = in.Query
+	def.Version++
+
+	updated, err := newProjectionData(def)
+	if err != nil {
+		return err
+	}
+
+	data.stop()
+
+	// the processor is stopped by now, so the projection is reported as faulted if it cannot be updated
+	if in.Reset {
+		if err := p.unlocked(data, func() error { return p.processors.Reset(updated.projection, p.cfg) }); err != nil {
+			data.status = StatusFaulted
+			data.lastErr = err
+			return err
+		}
+	}
+
+	if err := p.store.Put(ctx, updated.def); err != nil {
+		data.status = StatusFaulted
+		data.lastErr = err
+		return err
+	}
+
+	data.def = updated.def
+	data.projection = updated.projection
+	data.lastErr = nil
+	p.outputs.set(data.projection)
+
+	if !data.def.Enabled {
+		return nil
+	}
+
+	return p.start(data)
+}
+
+// Reset deletes the state of a projection and reprocesses its input streams from the beginning.
+func (p *projectionService) Reset(ctx context.Context, in ResetProjectionInput) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	data, err := p.lookup(in.Name)
+	if err != nil {
+		return err
+	}
 
+	if data.projection == nil {
+		return ErrProjectionInvalid
+	}
+
+	data.stop()
+
+	// the processor is stopped by now, so the projection is reported as faulted if it cannot be reset
+	if err := p.unlocked(data, func() error { return p.processors.Reset(data.projection, p.cfg) }); err != nil {
+		data.status = StatusFaulted
+		data.lastErr = err
+		return err
+	}
+
+	if !data.def.Enabled {
+		return nil
+	}
+
+	return p.start(data)
+}
+
+// Enable starts again a disabled projection, resuming from its committed offsets and state.
+func (p *projectionService) Enable(ctx context.Context, in EnableProjectionInput) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	data, err := p.lookup(in.Name)
+	if err != nil {
+		return err
+	}
+
+	if data.projection == nil {
+		return ErrProjectionInvalid
+	}
+
+	if !data.def.Enabled {
+		def := data.def
+		def.Enabled = true
+
+		if err := p.store.Put(ctx, def); err != nil {
+			return err
+		}
+		data.def = def
+	}
+
+	// the processor is either running or starting
+	if data.cancel != nil {
+		return nil
+	}
+
+	return p.start(data)
+}
+
+// Disable stops the processor of a projection, keeping its definition, offsets and state.
+func (p *projectionService) Disable(ctx context.Context, in DisableProjectionInput) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	data, err := p.lookup(in.Name)
+	if err != nil {
+		return err
+	}
+
+	if data.def.Enabled {
+		def := data.def
+		def.Enabled = false
+
+		if err := p.store.Put(ctx, def); err != nil {
+			return err
+		}
+		data.def = def
+	}
+
+	data.stop()
 	return nil
 }
 
+func (p *projectionService) Get(ctx context.Context, in GetProjectionInput) (ProjectionInfo, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	data, has := p.projections[in.Name]
+	if !has {
+		return ProjectionInfo{}, ErrProjectionNotExist
+	}
+	return data.info(), nil
+}
+
+func (p *projectionService) List(ctx context.Context) ([]ProjectionInfo, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	infos := make([]ProjectionInfo, 0, len(p.projections))
+	for _, data := range p.projections {
+		infos = append(infos, data.info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+func (p *projectionService) GetState(ctx context.Context, in GetStateInput) (any, error) {
+	p.mtx.Lock()
+	data, has := p.projections[in.Name]
+	if !has {
+		p.mtx.Unlock()
+		return nil, ErrProjectionNotExist
+	}
+	proc, proj, status := data.processor, data.projection, data.status
+	p.mtx.Unlock()
+
+	if status == StatusStarting {
+		return nil, processor.ErrStateNotReady
+	}
+
+	if proc == nil {
+		return nil, ErrProjectionStopped
+	}
+
+	partition := projections.GlobalPartition
+	switch {
+	case proj.IsPartitioned() && in.Partition == nil:
+		return nil, ErrPartitionRequired
+	case !proj.IsPartitioned() && in.Partition != nil:
+		return nil, ErrPartitionNotUsed
+	case in.Partition != nil:
+		partition = *in.Partition
+	}
+	return proc.GetState(partition)
+}
+
 func (p *projectionService) Shutdown() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
 	for _, data := range p.projections {
-		data.cancel()
+		data.generation++
+		if data.cancel != nil {
+			data.cancel()
+		}
 	}
 
 	for _, data := range p.projections {
-		data.processor.WaitShutdown()
+		if data.processor != nil {
+			data.processor.WaitShutdown()
+			data.processor.Close()
+		}
+	}
+	return p.store.Close()
+}
+
+// restore registers every projection found in the store and starts the enabled ones in background.
+// A projection which fails to start is kept as faulted, so that it can still be inspected and deleted.
+func (p *projectionService) restore(ctx context.Context) error {
+	defs, err := p.store.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for _, def := range defs {
+		data, err := newProjectionData(def)
+		if err != nil {
+			data = &projectionData{
+				def:     def,
+				status:  StatusFaulted,
+				lastErr: err,
+			}
+		} else {
+			p.outputs.set(data.projection)
+
+			if def.Enabled {
+				data.status = StatusStarting
+				go p.startRestored(data)
+			}
+		}
+		p.projections[def.Name] = data
 	}
 	return nil
 }
 
-func NewProjectionService(cfg processor.Config) ProjectionService {
-	return &projectionService{
+func (p *projectionService) startRestored(data *projectionData) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	// the projection was deleted, stopped or started by another request meanwhile
+	if p.projections[data.def.Name] != data || data.status != StatusStarting || data.cancel != nil {
+		return
+	}
+
+	if !data.def.Enabled {
+		data.status = StatusStopped
+		return
+	}
+
+	if err := p.start(data); err != nil && !errors.Is(err, errStartCanceled) {
+		log.WithField("projection", data.def.Name).Error(err)
+	}
+}
+
+func NewProjectionService(cfg processor.Config, st store.Store) (ProjectionService, error) {
+	return newProjectionService(cfg, st, kafkaProcessors{})
+}
+
+func newProjectionService(cfg processor.Config, st store.Store, processors processorFactory) (*projectionService, error) {
+	svc := &projectionService{
 		cfg:         cfg,
-		projections: make(map[string]projectionData),
+		store:       st,
+		processors:  processors,
+		projections: make(map[string]*projectionData),
+		outputs:     newOutputRegistry(),
+	}
+	svc.cfg.ExcludeStream = svc.outputs.contains
+
+	if err := svc.restore(context.Background()); err != nil {
+		return nil, err
 	}
+	return svc, nil
 }
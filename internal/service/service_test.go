@@ -0,0 +1,722 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ostafen/hermes/internal/processor"
+	"github.com/ostafen/hermes/internal/projections"
+	"github.com/ostafen/hermes/internal/store"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	countQuery       = `fromStream("orders").when({ $init: () => 0, Added: (s, e) => s + 1 })`
+	partitionedQuery = `fromStream("orders").partitionBy(e => e.body.customer).when({ $init: () => 0, Added: (s, e) => s + 1 })`
+)
+
+// memStore keeps definitions in memory.
+type memStore struct {
+	mtx  sync.Mutex
+	defs map[string]store.Definition
+	err  error
+}
+
+func newMemStore(defs ...store.Definition) *memStore {
+	s := &memStore{defs: make(map[string]store.Definition)}
+	for _, def := range defs {
+		s.defs[def.Name] = def
+	}
+	return s
+}
+
+func (s *memStore) Put(ctx context.Context, def store.Definition) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	s.defs[def.Name] = def
+	return nil
+}
+
+func (s *memStore) Delete(ctx context.Context, name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	delete(s.defs, name)
+	return nil
+}
+
+func (s *memStore) List(ctx context.Context) ([]store.Definition, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	defs := make([]store.Definition, 0, len(s.defs))
+	for _, def := range s.defs {
+		defs = append(defs, def)
+	}
+
+	sort.Slice(defs, func(i, j int) bool {
+		return defs[i].Name < defs[j].Name
+	})
+	return defs, nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+func (s *memStore) get(name string) (store.Definition, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	def, has := s.defs[name]
+	return def, has
+}
+
+// fakeProcessor runs until its context is canceled or it fails.
+type fakeProcessor struct {
+	projection *projections.Projection
+
+	mtx    sync.Mutex
+	err    error
+	closed bool
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func (p *fakeProcessor) InputStreams() []string {
+	return p.projection.InputStreams
+}
+
+func (p *fakeProcessor) GetState(partition string) (any, error) {
+	return "state of " + partition, nil
+}
+
+func (p *fakeProcessor) Err() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.err
+}
+
+func (p *fakeProcessor) WaitShutdown() {
+	<-p.done
+}
+
+func (p *fakeProcessor) Close() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.closed = true
+	return nil
+}
+
+func (p *fakeProcessor) isClosed() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.closed
+}
+
+func (p *fakeProcessor) stop(err error) {
+	p.mtx.Lock()
+	p.err = err
+	p.mtx.Unlock()
+
+	p.doneOnce.Do(func() { close(p.done) })
+}
+
+// fakeProcessors starts fake processors, and records the deleted and reset projections.
+type fakeProcessors struct {
+	mtx        sync.Mutex
+	started    map[string][]*fakeProcessor
+	startErr   error
+	resetErr   error
+	resets     []string
+	deletes    map[string]processor.DeleteOptions
+	startBlock chan struct{}
+	// adminBlock, if set, blocks deletes and resets until it is closed.
+	adminBlock chan struct{}
+}
+
+func newFakeProcessors() *fakeProcessors {
+	return &fakeProcessors{
+		started: make(map[string][]*fakeProcessor),
+		deletes: make(map[string]processor.DeleteOptions),
+	}
+}
+
+func (f *fakeProcessors) Start(ctx context.Context, p *projections.Projection, cfg processor.Config) (projectionProcessor, error) {
+	f.mtx.Lock()
+	startErr, block := f.startErr, f.startBlock
+	f.mtx.Unlock()
+
+	if block != nil {
+		select {
+		case <-block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if startErr != nil {
+		return nil, startErr
+	}
+
+	proc := &fakeProcessor{projection: p, done: make(chan struct{})}
+	go func() {
+		<-ctx.Done()
+		proc.stop(nil)
+	}()
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.started[p.Name] = append(f.started[p.Name], proc)
+	return proc, nil
+}
+
+func (f *fakeProcessors) waitAdmin() {
+	f.mtx.Lock()
+	block := f.adminBlock
+	f.mtx.Unlock()
+
+	if block != nil {
+		<-block
+	}
+}
+
+func (f *fakeProcessors) Reset(p *projections.Projection, cfg processor.Config) error {
+	f.waitAdmin()
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.resets = append(f.resets, p.Name)
+	return f.resetErr
+}
+
+func (f *fakeProcessors) Delete(p *projections.Projection, cfg processor.Config, opts processor.DeleteOptions) error {
+	f.waitAdmin()
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.deletes[p.Name] = opts
+	return nil
+}
+
+func (f *fakeProcessors) processors(name string) []*fakeProcessor {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return append([]*fakeProcessor(nil), f.started[name]...)
+}
+
+func newTestService(t *testing.T, st *memStore, processors *fakeProcessors) *projectionService {
+	svc, err := newProjectionService(processor.Config{}, st, processors)
+	require.NoError(t, err)
+	t.Cleanup(func() { svc.Shutdown() })
+	return svc
+}
+
+func requireStatus(t *testing.T, svc ProjectionService, name string, status Status) ProjectionInfo {
+	t.Helper()
+
+	var info ProjectionInfo
+	require.Eventually(t, func() bool {
+		var err error
+		info, err = svc.Get(context.Background(), GetProjectionInput{Name: name})
+		return err == nil && info.Status == status
+	}, time.Second, time.Millisecond)
+	return info
+}
+
+func TestCreate(t *testing.T) {
+	ctx := context.Background()
+
+	st := newMemStore()
+	procs := newFakeProcessors()
+	svc := newTestService(t, st, procs)
+
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+
+	info := requireStatus(t, svc, "count", StatusRunning)
+	require.Equal(t, ProjectionInfo{
+		Name:         "count",
+		Query:        countQuery,
+		Version:      1,
+		InputStreams: []string{"orders"},
+		ResultStream: "projections-count-result",
+		Enabled:      true,
+		Status:       StatusRunning,
+	}, info)
+
+	def, has := st.get("count")
+	require.True(t, has)
+	require.Equal(t, 1, def.Version)
+	require.True(t, def.Enabled)
+
+	require.ErrorIs(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}), ErrProjectionExist)
+	require.Len(t, procs.processors("count"), 1)
+
+	require.ErrorIs(t, svc.Create(ctx, CreateProjectionInput{Name: "invalid", Query: "fromStream("}), ErrInvalidQuery)
+	_, has = st.get("invalid")
+	require.False(t, has)
+
+	infos, err := svc.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+}
+
+func TestCreateFailures(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("start", func(t *testing.T) {
+		st := newMemStore()
+		procs := newFakeProcessors()
+		procs.startErr = errors.New("no brokers")
+		svc := newTestService(t, st, procs)
+
+		require.ErrorIs(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}), procs.startErr)
+
+		_, err := svc.Get(ctx, GetProjectionInput{Name: "count"})
+		require.ErrorIs(t, err, ErrProjectionNotExist)
+
+		_, has := st.get("count")
+		require.False(t, has)
+	})
+
+	t.Run("store", func(t *testing.T) {
+		st := newMemStore()
+		st.err = errors.New("store unavailable")
+		procs := newFakeProcessors()
+		svc := newTestService(t, st, procs)
+
+		require.ErrorIs(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}), st.err)
+
+		_, err := svc.Get(ctx, GetProjectionInput{Name: "count"})
+		require.ErrorIs(t, err, ErrProjectionNotExist)
+
+		started := procs.processors("count")
+		require.Len(t, started, 1)
+		require.True(t, started[0].isClosed())
+	})
+}
+
+func TestStarting(t *testing.T) {
+	ctx := context.Background()
+
+	procs := newFakeProcessors()
+	procs.startBlock = make(chan struct{})
+	svc := newTestService(t, newMemStore(), procs)
+
+	created := make(chan error, 1)
+	go func() {
+		created <- svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery})
+	}()
+
+	requireStatus(t, svc, "count", StatusStarting)
+
+	_, err := svc.GetState(ctx, GetStateInput{Name: "count"})
+	require.ErrorIs(t, err, processor.ErrStateNotReady)
+
+	close(procs.startBlock)
+	require.NoError(t, <-created)
+	requireStatus(t, svc, "count", StatusRunning)
+}
+
+func TestChangesWhileCreating(t *testing.T) {
+	ctx := context.Background()
+
+	changes := map[string]func(svc *projectionService) error{
+		"reset": func(svc *projectionService) error {
+			return svc.Reset(ctx, ResetProjectionInput{Name: "count"})
+		},
+		"disable": func(svc *projectionService) error {
+			return svc.Disable(ctx, DisableProjectionInput{Name: "count"})
+		},
+		"enable": func(svc *projectionService) error {
+			return svc.Enable(ctx, EnableProjectionInput{Name: "count"})
+		},
+		"update query": func(svc *projectionService) error {
+			return svc.UpdateQuery(ctx, UpdateQueryInput{Name: "count", Query: partitionedQuery})
+		},
+		"delete": func(svc *projectionService) error {
+			return svc.Delete(ctx, DeleteProjectionInput{Name: "count"})
+		},
+	}
+
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			st := newMemStore()
+			procs := newFakeProcessors()
+			procs.startBlock = make(chan struct{})
+			svc := newTestService(t, st, procs)
+
+			created := make(chan error, 1)
+			go func() {
+				created <- svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery})
+			}()
+
+			requireStatus(t, svc, "count", StatusStarting)
+			require.ErrorIs(t, change(svc), ErrProjectionBusy)
+
+			close(procs.startBlock)
+			require.NoError(t, <-created)
+
+			info := requireStatus(t, svc, "count", StatusRunning)
+			require.Equal(t, 1, info.Version)
+			require.True(t, info.Enabled)
+
+			def, has := st.get("count")
+			require.True(t, has)
+			require.True(t, def.Enabled)
+
+			started := procs.processors("count")
+			require.Len(t, started, 1)
+			require.False(t, started[0].isClosed())
+			require.Empty(t, procs.resets)
+
+			// the projection can be changed once created
+			require.NoError(t, change(svc))
+		})
+	}
+}
+
+func TestDisableEnable(t *testing.T) {
+	ctx := context.Background()
+
+	st := newMemStore()
+	procs := newFakeProcessors()
+	svc := newTestService(t, st, procs)
+
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+
+	require.NoError(t, svc.Disable(ctx, DisableProjectionInput{Name: "count"}))
+	info := requireStatus(t, svc, "count", StatusStopped)
+	require.False(t, info.Enabled)
+	require.True(t, procs.processors("count")[0].isClosed())
+
+	def, _ := st.get("count")
+	require.False(t, def.Enabled)
+
+	_, err := svc.GetState(ctx, GetStateInput{Name: "count"})
+	require.ErrorIs(t, err, ErrProjectionStopped)
+
+	// disabling a stopped projection does nothing
+	require.NoError(t, svc.Disable(ctx, DisableProjectionInput{Name: "count"}))
+
+	require.NoError(t, svc.Enable(ctx, EnableProjectionInput{Name: "count"}))
+	info = requireStatus(t, svc, "count", StatusRunning)
+	require.True(t, info.Enabled)
+
+	def, _ = st.get("count")
+	require.True(t, def.Enabled)
+
+	// enabling a running projection does not restart it
+	require.NoError(t, svc.Enable(ctx, EnableProjectionInput{Name: "count"}))
+	require.Len(t, procs.processors("count"), 2)
+
+	require.ErrorIs(t, svc.Enable(ctx, EnableProjectionInput{Name: "missing"}), ErrProjectionNotExist)
+	require.ErrorIs(t, svc.Disable(ctx, DisableProjectionInput{Name: "missing"}), ErrProjectionNotExist)
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+
+	st := newMemStore()
+	procs := newFakeProcessors()
+	svc := newTestService(t, st, procs)
+
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+	require.True(t, svc.outputs.contains("projections-count-result"))
+
+	require.NoError(t, svc.Delete(ctx, DeleteProjectionInput{Name: "count", DeleteState: true}))
+
+	_, err := svc.Get(ctx, GetProjectionInput{Name: "count"})
+	require.ErrorIs(t, err, ErrProjectionNotExist)
+
+	_, has := st.get("count")
+	require.False(t, has)
+
+	require.True(t, procs.processors("count")[0].isClosed())
+	require.Equal(t, map[string]processor.DeleteOptions{"count": {State: true}}, procs.deletes)
+	require.False(t, svc.outputs.contains("projections-count-result"))
+
+	require.ErrorIs(t, svc.Delete(ctx, DeleteProjectionInput{Name: "count"}), ErrProjectionNotExist)
+
+	// the name can be taken again
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+}
+
+func TestChangesWhileAdministering(t *testing.T) {
+	ctx := context.Background()
+
+	changes := map[string]func(svc *projectionService) error{
+		"reset": func(svc *projectionService) error {
+			return svc.Reset(ctx, ResetProjectionInput{Name: "count"})
+		},
+		"reset query": func(svc *projectionService) error {
+			return svc.UpdateQuery(ctx, UpdateQueryInput{Name: "count", Query: partitionedQuery, Reset: true})
+		},
+		"delete": func(svc *projectionService) error {
+			return svc.Delete(ctx, DeleteProjectionInput{Name: "count", DeleteState: true})
+		},
+	}
+
+	for name, change := range changes {
+		t.Run(name, func(t *testing.T) {
+			procs := newFakeProcessors()
+			svc := newTestService(t, newMemStore(), procs)
+
+			require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+
+			procs.mtx.Lock()
+			procs.adminBlock = make(chan struct{})
+			procs.mtx.Unlock()
+
+			changed := make(chan error, 1)
+			go func() {
+				changed <- change(svc)
+			}()
+
+			// the service stays responsive while Kafka is administered, while the projection can't be changed
+			require.Eventually(t, func() bool {
+				return errors.Is(svc.Disable(ctx, DisableProjectionInput{Name: "count"}), ErrProjectionBusy)
+			}, time.Second, time.Millisecond)
+
+			_, err := svc.List(ctx)
+			require.NoError(t, err)
+
+			close(procs.adminBlock)
+			require.NoError(t, <-changed)
+		})
+	}
+}
+
+func TestProcessorFailure(t *testing.T) {
+	ctx := context.Background()
+
+	procs := newFakeProcessors()
+	svc := newTestService(t, newMemStore(), procs)
+
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+
+	failed := procs.processors("count")[0]
+	failed.stop(errors.New("handler failed"))
+
+	info := requireStatus(t, svc, "count", StatusFaulted)
+	require.Equal(t, "handler failed", info.LastError)
+	require.True(t, info.Enabled)
+	require.Eventually(t, failed.isClosed, time.Second, time.Millisecond)
+
+	_, err := svc.GetState(ctx, GetStateInput{Name: "count"})
+	require.ErrorIs(t, err, ErrProjectionStopped)
+
+	// enabling a faulted projection restarts it
+	require.NoError(t, svc.Enable(ctx, EnableProjectionInput{Name: "count"}))
+	info = requireStatus(t, svc, "count", StatusRunning)
+	require.Empty(t, info.LastError)
+}
+
+func TestProcessorFenced(t *testing.T) {
+	ctx := context.Background()
+
+	procs := newFakeProcessors()
+	svc := newTestService(t, newMemStore(), procs)
+
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+
+	// a fenced processor is started again, to recover its state
+	fenced := procs.processors("count")[0]
+	fenced.stop(fmt.Errorf("error committing transaction: %w", processor.ErrFenced))
+
+	require.Eventually(t, func() bool { return len(procs.processors("count")) == 2 }, time.Second, time.Millisecond)
+	require.True(t, fenced.isClosed())
+
+	info := requireStatus(t, svc, "count", StatusRunning)
+	require.Empty(t, info.LastError)
+}
+
+func TestUpdateQuery(t *testing.T) {
+	ctx := context.Background()
+
+	st := newMemStore()
+	procs := newFakeProcessors()
+	svc := newTestService(t, st, procs)
+
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+
+	require.ErrorIs(t, svc.UpdateQuery(ctx, UpdateQueryInput{Name: "count", Query: "fromStream("}), ErrInvalidQuery)
+	info := requireStatus(t, svc, "count", StatusRunning)
+	require.Equal(t, 1, info.Version)
+
+	require.NoError(t, svc.UpdateQuery(ctx, UpdateQueryInput{Name: "count", Query: partitionedQuery}))
+	info = requireStatus(t, svc, "count", StatusRunning)
+	require.Equal(t, 2, info.Version)
+	require.True(t, info.Partitioned)
+	require.Empty(t, procs.resets)
+
+	def, _ := st.get("count")
+	require.Equal(t, partitionedQuery, def.Query)
+	require.Equal(t, 2, def.Version)
+
+	started := procs.processors("count")
+	require.Len(t, started, 2)
+	require.True(t, started[0].isClosed())
+
+	require.NoError(t, svc.UpdateQuery(ctx, UpdateQueryInput{Name: "count", Query: countQuery, Reset: true}))
+	require.Equal(t, []string{"count"}, procs.resets)
+
+	require.ErrorIs(t, svc.UpdateQuery(ctx, UpdateQueryInput{Name: "missing", Query: countQuery}), ErrProjectionNotExist)
+}
+
+func TestUpdateQueryOfDisabledProjection(t *testing.T) {
+	ctx := context.Background()
+
+	procs := newFakeProcessors()
+	svc := newTestService(t, newMemStore(), procs)
+
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+	require.NoError(t, svc.Disable(ctx, DisableProjectionInput{Name: "count"}))
+
+	require.NoError(t, svc.UpdateQuery(ctx, UpdateQueryInput{Name: "count", Query: partitionedQuery}))
+	info := requireStatus(t, svc, "count", StatusStopped)
+	require.Equal(t, 2, info.Version)
+	require.Len(t, procs.processors("count"), 1)
+}
+
+func TestReset(t *testing.T) {
+	ctx := context.Background()
+
+	procs := newFakeProcessors()
+	svc := newTestService(t, newMemStore(), procs)
+
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+
+	require.NoError(t, svc.Reset(ctx, ResetProjectionInput{Name: "count"}))
+	requireStatus(t, svc, "count", StatusRunning)
+	require.Equal(t, []string{"count"}, procs.resets)
+	require.Len(t, procs.processors("count"), 2)
+
+	procs.resetErr = errors.New("reset failed")
+	require.ErrorIs(t, svc.Reset(ctx, ResetProjectionInput{Name: "count"}), procs.resetErr)
+
+	info := requireStatus(t, svc, "count", StatusFaulted)
+	require.Equal(t, "reset failed", info.LastError)
+
+	require.ErrorIs(t, svc.Reset(ctx, ResetProjectionInput{Name: "missing"}), ErrProjectionNotExist)
+}
+
+func TestGetState(t *testing.T) {
+	ctx := context.Background()
+
+	svc := newTestService(t, newMemStore(), newFakeProcessors())
+
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "partitioned", Query: partitionedQuery}))
+
+	state, err := svc.GetState(ctx, GetStateInput{Name: "count"})
+	require.NoError(t, err)
+	require.Equal(t, "state of "+projections.GlobalPartition, state)
+
+	partition := "c1"
+	_, err = svc.GetState(ctx, GetStateInput{Name: "count", Partition: &partition})
+	require.ErrorIs(t, err, ErrPartitionNotUsed)
+
+	_, err = svc.GetState(ctx, GetStateInput{Name: "partitioned"})
+	require.ErrorIs(t, err, ErrPartitionRequired)
+
+	state, err = svc.GetState(ctx, GetStateInput{Name: "partitioned", Partition: &partition})
+	require.NoError(t, err)
+	require.Equal(t, "state of c1", state)
+
+	_, err = svc.GetState(ctx, GetStateInput{Name: "missing"})
+	require.ErrorIs(t, err, ErrProjectionNotExist)
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+
+	st := newMemStore(
+		store.Definition{Name: "enabled", Query: countQuery, Enabled: true, Version: 2},
+		store.Definition{Name: "disabled", Query: countQuery, Version: 1},
+		store.Definition{Name: "invalid", Query: "fromStream(", Enabled: true, Version: 1},
+	)
+	procs := newFakeProcessors()
+	svc := newTestService(t, st, procs)
+
+	info := requireStatus(t, svc, "enabled", StatusRunning)
+	require.Equal(t, 2, info.Version)
+	require.True(t, svc.outputs.contains("projections-enabled-result"))
+
+	requireStatus(t, svc, "disabled", StatusStopped)
+	require.Empty(t, procs.processors("disabled"))
+
+	info = requireStatus(t, svc, "invalid", StatusFaulted)
+	require.NotEmpty(t, info.LastError)
+
+	// a projection whose query does not compile can only be updated, or deleted without its state
+	require.ErrorIs(t, svc.Enable(ctx, EnableProjectionInput{Name: "invalid"}), ErrProjectionInvalid)
+	require.ErrorIs(t, svc.Reset(ctx, ResetProjectionInput{Name: "invalid"}), ErrProjectionInvalid)
+	require.ErrorIs(t, svc.Delete(ctx, DeleteProjectionInput{Name: "invalid", DeleteState: true}), ErrProjectionInvalid)
+	require.ErrorIs(t, svc.Delete(ctx, DeleteProjectionInput{Name: "invalid", DeleteEmittedStreams: true}), ErrProjectionInvalid)
+
+	require.NoError(t, svc.UpdateQuery(ctx, UpdateQueryInput{Name: "invalid", Query: countQuery}))
+	info = requireStatus(t, svc, "invalid", StatusRunning)
+	require.Equal(t, 2, info.Version)
+	require.Empty(t, info.LastError)
+
+	require.NoError(t, svc.Delete(ctx, DeleteProjectionInput{Name: "disabled"}))
+	_, has := st.get("disabled")
+	require.False(t, has)
+}
+
+func TestRestoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	st := newMemStore()
+	svc, err := newProjectionService(processor.Config{}, st, newFakeProcessors())
+	require.NoError(t, err)
+
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "partitioned", Query: partitionedQuery}))
+	require.NoError(t, svc.UpdateQuery(ctx, UpdateQueryInput{Name: "partitioned", Query: countQuery}))
+	require.NoError(t, svc.Disable(ctx, DisableProjectionInput{Name: "count"}))
+
+	before, err := svc.List(ctx)
+	require.NoError(t, err)
+	require.NoError(t, svc.Shutdown())
+
+	restored := newTestService(t, st, newFakeProcessors())
+	requireStatus(t, restored, "partitioned", StatusRunning)
+
+	after, err := restored.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+func TestShutdown(t *testing.T) {
+	ctx := context.Background()
+
+	procs := newFakeProcessors()
+	svc, err := newProjectionService(processor.Config{}, newMemStore(), procs)
+	require.NoError(t, err)
+
+	require.NoError(t, svc.Create(ctx, CreateProjectionInput{Name: "count", Query: countQuery}))
+	require.NoError(t, svc.Shutdown())
+	require.True(t, procs.processors("count")[0].isClosed())
+}
@@ -0,0 +1,49 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/ostafen/hermes/internal/projections"
+)
+
+// outputRegistry keeps track of the streams written by every projection,
+// so that they are never selected by dynamic selectors such as fromAll().
+// It has its own lock, since it is accessed by processors while the service lock may be held.
+type outputRegistry struct {
+	mtx     sync.RWMutex
+	streams map[string][]string
+}
+
+func newOutputRegistry() *outputRegistry {
+	return &outputRegistry{
+		streams: make(map[string][]string),
+	}
+}
+
+func (r *outputRegistry) set(p *projections.Projection) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.streams[p.Name] = []string{p.ResultStream(), p.StateStream(), p.DeadLetterStream()}
+}
+
+func (r *outputRegistry) remove(name string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	delete(r.streams, name)
+}
+
+func (r *outputRegistry) contains(stream string) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	for _, streams := range r.streams {
+		for _, s := range streams {
+			if s == stream {
+				return true
+			}
+		}
+	}
+	return false
+}
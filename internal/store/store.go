@@ -0,0 +1,161 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/lovoo/goka"
+	"github.com/lovoo/goka/codec"
+	"github.com/lovoo/goka/storage"
+	"github.com/ostafen/hermes/internal/projections"
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultTopic = "hermes-projections"
+
+type Definition struct {
+	Name    string              `json:"name"`
+	Query   string              `json:"query"`
+	Options projections.Options `json:"options"`
+	Enabled bool                `json:"enabled"`
+	Version int                 `json:"version"`
+}
+
+type Store interface {
+	Put(ctx context.Context, def Definition) error
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context) ([]Definition, error)
+	Close() error
+}
+
+// kafkaStore keeps projection definitions in a compacted topic, keyed by projection name.
+type kafkaStore struct {
+	mtx sync.Mutex
+
+	brokers []string
+	topic   string
+	emitter *goka.Emitter
+}
+
+func NewKafkaStore(brokers []string, topic string, replication int) (Store, error) {
+	tmc := goka.NewTopicManagerConfig()
+	tmc.Table.Replication = replication
+
+	tpm, err := goka.NewTopicManager(brokers, goka.DefaultConfig(), tmc)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm.Close()
+
+	if err := tpm.EnsureTableExists(topic, 1); err != nil {
+		return nil, err
+	}
+
+	emitter, err := goka.NewEmitter(brokers, goka.Stream(topic), &codec.Bytes{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &kafkaStore{
+		brokers: brokers,
+		topic:   topic,
+		emitter: emitter,
+	}, nil
+}
+
+func (s *kafkaStore) Put(ctx context.Context, def Definition) error {
+	data, err := encodeDefinition(def)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.emitter.EmitSync(def.Name, data)
+}
+
+func (s *kafkaStore) Delete(ctx context.Context, name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// a nil value is written as a tombstone, which compaction eventually removes
+	return s.emitter.EmitSync(name, nil)
+}
+
+func (s *kafkaStore) List(ctx context.Context) ([]Definition, error) {
+	view, err := goka.NewView(s.brokers, goka.Table(s.topic), &codec.Bytes{},
+		goka.WithViewStorageBuilder(storage.MemoryBuilder()),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	viewCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- view.Run(viewCtx)
+	}()
+
+	select {
+	case <-view.WaitRunning():
+	case err := <-errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	defs, err := listDefinitions(view)
+
+	cancel()
+	<-errCh
+
+	return defs, err
+}
+
+func listDefinitions(view *goka.View) ([]Definition, error) {
+	it, err := view.Iterator()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Release()
+
+	return readDefinitions(it)
+}
+
+// encodeDefinition encodes a definition as the value of its record, which readDefinitions decodes.
+func encodeDefinition(def Definition) ([]byte, error) {
+	return json.Marshal(def)
+}
+
+// readDefinitions reads the definitions of a table.
+// Records which cannot be decoded are skipped, so that a single corrupt definition does not prevent the others from being restored.
+func readDefinitions(it goka.Iterator) ([]Definition, error) {
+	defs := make([]Definition, 0)
+	for it.Next() {
+		val, err := it.Value()
+		if err != nil {
+			return nil, err
+		}
+
+		data, _ := val.([]byte)
+		if data == nil {
+			continue
+		}
+
+		var def Definition
+		if err := json.Unmarshal(data, &def); err != nil {
+			log.WithField("projection", it.Key()).Errorf("skipping invalid definition: %s", err)
+			continue
+		}
+		defs = append(defs, def)
+	}
+	return defs, it.Err()
+}
+
+func (s *kafkaStore) Close() error {
+	return s.emitter.Finish()
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/lovoo/goka"
+	"github.com/ostafen/hermes/internal/projections"
+	"github.com/stretchr/testify/require"
+)
+
+// sliceIterator iterates over a fixed list of records, as a goka.Iterator.
+type sliceIterator struct {
+	keys   []string
+	values []any
+	pos    int
+}
+
+var _ goka.Iterator = (*sliceIterator)(nil)
+
+func (it *sliceIterator) Next() bool {
+	it.pos++
+	return it.pos <= len(it.keys)
+}
+
+func (it *sliceIterator) Err() error           { return nil }
+func (it *sliceIterator) Key() string          { return it.keys[it.pos-1] }
+func (it *sliceIterator) Value() (any, error)  { return it.values[it.pos-1], nil }
+func (it *sliceIterator) Release()             {}
+func (it *sliceIterator) Seek(key string) bool { return false }
+
+func TestReadDefinitions(t *testing.T) {
+	it := &sliceIterator{
+		keys: []string{"first", "corrupt", "deleted", "second"},
+		values: []any{
+			[]byte(`{"name":"first","query":"fromStream('a')","enabled":true,"version":1}`),
+			[]byte(`{"name":`),
+			nil,
+			[]byte(`{"name":"second","query":"fromStream('b')","version":3}`),
+		},
+	}
+
+	defs, err := readDefinitions(it)
+	require.NoError(t, err)
+	require.Equal(t, []Definition{
+		{Name: "first", Query: "fromStream('a')", Enabled: true, Version: 1},
+		{Name: "second", Query: "fromStream('b')", Version: 3},
+	}, defs)
+}
+
+func TestDefinitionRoundTrip(t *testing.T) {
+	defs := []Definition{
+		{Name: "minimal", Query: "fromStream('a')"},
+		{
+			Name:    "full",
+			Query:   "fromAll().when({})",
+			Enabled: true,
+			Version: 7,
+			Options: projections.Options{
+				ResultStream:     "totals",
+				DeadLetterStream: "failures",
+				ErrorPolicy:      projections.ErrorPolicyDeadLetter,
+				IncludeLinks:     true,
+				ReorderEvents:    true,
+				ProcessingLag:    250,
+				DeletedEventType: "Removed",
+				Decoders:         map[string]string{"*": "avro"},
+				ResultSubject:    "totals-value",
+				Inputs: map[string]projections.InputMapping{
+					"orders": {
+						Type:        "$.type",
+						EventId:     "header:id",
+						ContentType: "application/json",
+						Metadata:    map[string]string{"source": "$key"},
+					},
+				},
+			},
+		},
+	}
+
+	it := &sliceIterator{}
+	for _, def := range defs {
+		data, err := encodeDefinition(def)
+		require.NoError(t, err)
+
+		it.keys = append(it.keys, def.Name)
+		it.values = append(it.values, data)
+	}
+
+	read, err := readDefinitions(it)
+	require.NoError(t, err)
+	require.Equal(t, defs, read)
+}